@@ -218,3 +218,330 @@ function push_ChangeSub(dev_id, folder_id, sub_id, now, delta, priority)
 
 	return res
 end
+
+--[[
+Sub / device deletion
+--]]
+
+function push_DeleteSub(dev_id, folder_id, sub_id)
+	local res = RES_OK
+
+	local t_sub = space_subs:get({dev_id, folder_id})
+
+	if t_sub == nil
+	then
+		res = RES_ERR_UNKNOWN_SUB_ID
+	elseif t_sub[1] ~= sub_id
+	then
+		res = RES_ERR_MISMATCHING_SUB_ID_DEV_ID
+	else
+		space_subs:delete({dev_id, folder_id})
+	end
+
+	return res
+end
+
+-- Deletes the subs of a device, call inside a transaction
+local function delete_dev_subs(dev_id)
+	-- Select first, deleting while iterating an index is not safe
+	local t_subs = space_subs.index.dev_id:select{dev_id}
+	for _, t_sub in ipairs(t_subs) do
+		space_subs:delete({t_sub[2], t_sub[5]})
+	end
+	return #t_subs
+end
+
+function push_DeleteDev(dev_id)
+	local res = RES_OK
+
+	box.begin()
+
+	local t_dev = space_devs:delete(dev_id)
+
+	if t_dev == nil
+	then
+		res = RES_ERR_UNKNOWN_DEV_ID
+	else
+		delete_dev_subs(dev_id)
+	end
+
+	box.commit()
+
+	return res
+end
+
+--[[
+Inactive device purge: deletes devices with ping_ts before before_ts, with their
+subs, walking the devs ping_ts index in batches. The cursor works as in
+push_SweepSubs. push_PingSub only updates the sub, so a device with a sub pinged
+at or after before_ts is kept, and listed with kept = 1 and that sub's ping_ts.
+With dry_run nothing is deleted, the devices are only listed.
+--]]
+
+function push_PurgeDevs(cursor_ts, cursor_skip, before_ts, batch, dry_run)
+	local t_list = {}
+	local skip = cursor_skip
+	local next_ts = cursor_ts
+	local next_skip = cursor_skip
+	local kept_at_next = 0
+	local done = 1
+
+	for _, t_dev in space_devs.index.ping_ts:pairs({cursor_ts}, {iterator = 'GE'}) do
+		local ping_ts = t_dev[5]
+		if ping_ts >= before_ts
+		then
+			break
+		end
+
+		if skip > 0 and ping_ts == cursor_ts
+		then
+			skip = skip - 1
+		else
+			if #t_list >= batch
+			then
+				done = 0
+				break
+			end
+
+			if ping_ts == next_ts
+			then
+				next_skip = next_skip + 1
+			else
+				next_ts = ping_ts
+				next_skip = 1
+				kept_at_next = 0
+			end
+
+			local subs = 0
+			local last_ts = ping_ts
+			for _, t_sub in space_subs.index.dev_id:pairs({t_dev[1]}, {iterator = 'EQ'}) do
+				subs = subs + 1
+				if t_sub[3] > last_ts
+				then
+					last_ts = t_sub[3]
+				end
+			end
+
+			local kept = 0
+			if last_ts >= before_ts
+			then
+				kept = 1
+				kept_at_next = kept_at_next + 1
+			end
+
+			table.insert(t_list, {t_dev[1], last_ts, subs, kept})
+		end
+	end
+
+	local devs = 0
+	local subs = 0
+	for _, t_item in ipairs(t_list) do
+		if t_item[4] == 0
+		then
+			devs = devs + 1
+			subs = subs + t_item[3]
+		end
+	end
+
+	if dry_run == 0
+	then
+		box.begin()
+
+		for _, t_item in ipairs(t_list) do
+			if t_item[4] == 0
+			then
+				space_devs:delete(t_item[1])
+				delete_dev_subs(t_item[1])
+			end
+		end
+
+		box.commit()
+
+		-- Deleted devices are out of the index, only kept ones are skipped
+		if next_ts == cursor_ts
+		then
+			next_skip = cursor_skip + kept_at_next
+		else
+			next_skip = kept_at_next
+		end
+	end
+
+	return {devs, subs, next_ts, next_skip, done, t_list}
+end
+
+--[[
+Stale sub sweep: marks subs with ping_ts before before_ts as dead, walking the
+ping_ts index in batches. The cursor is a ping_ts and the number of subs with
+that ping_ts which were already scanned.
+--]]
+
+function push_SweepSubs(cursor_ts, cursor_skip, before_ts, batch)
+	local t_keys = {}
+	local scanned = 0
+	local skip = cursor_skip
+	local next_ts = cursor_ts
+	local next_skip = cursor_skip
+	local done = 1
+
+	for _, t_sub in space_subs.index.ping_ts:pairs({cursor_ts}, {iterator = 'GE'}) do
+		local ping_ts = t_sub[3]
+		if ping_ts >= before_ts
+		then
+			break
+		end
+
+		if skip > 0 and ping_ts == cursor_ts
+		then
+			skip = skip - 1
+		else
+			if scanned >= batch
+			then
+				done = 0
+				break
+			end
+
+			scanned = scanned + 1
+			if ping_ts == next_ts
+			then
+				next_skip = next_skip + 1
+			else
+				next_ts = ping_ts
+				next_skip = 1
+			end
+
+			-- ews_is_dead
+			if t_sub[7] ~= 1
+			then
+				table.insert(t_keys, {t_sub[2], t_sub[5]})
+			end
+		end
+	end
+
+	-- Update after the scan, updates yield and the iterator must not
+	box.begin()
+
+	for _, key in ipairs(t_keys) do
+		space_subs:update(key, {
+			-- ews_is_alive: false
+			{'=', 6, 0},
+			-- ews_is_dead: true
+			{'=', 7, 1}})
+	end
+
+	box.commit()
+
+	return {#t_keys, scanned, next_ts, next_skip, done}
+end
+
+--[[
+Push dispatch: takes devices with change_count > 0 and change_ts up to now,
+scanning up to batch devices of the devs change_ts index from the cursor as in
+push_SweepSubs. Taken devices are leased by moving change_ts to now + lease so
+that they are not taken again while being sent, and are returned as they are
+after that.
+--]]
+
+function push_TakeDueDevs(cursor_ts, cursor_skip, now, batch, lease)
+	local t_keys = {}
+	local scanned = 0
+	local skip = cursor_skip
+	local next_ts = cursor_ts
+	local next_skip = cursor_skip
+	local done = 1
+
+	for _, t_dev in space_devs.index.change_ts:pairs({cursor_ts}, {iterator = 'GE'}) do
+		local change_ts = t_dev[6]
+		if change_ts > now
+		then
+			break
+		end
+
+		if skip > 0 and change_ts == cursor_ts
+		then
+			skip = skip - 1
+		else
+			if scanned >= batch
+			then
+				done = 0
+				break
+			end
+
+			scanned = scanned + 1
+			if change_ts ~= next_ts
+			then
+				next_ts = change_ts
+				next_skip = 0
+			end
+
+			-- change_count
+			if t_dev[7] > 0
+			then
+				-- Moves out of the scanned range
+				table.insert(t_keys, t_dev[1])
+			else
+				next_skip = next_skip + 1
+			end
+		end
+	end
+
+	local t_devs = {}
+
+	box.begin()
+
+	for _, dev_id in ipairs(t_keys) do
+		-- change_ts: now + lease
+		table.insert(t_devs, space_devs:update(dev_id, {{'=', 6, now + lease}}))
+	end
+
+	box.commit()
+
+	return {next_ts, next_skip, done, t_devs}
+end
+
+-- Called after a send: on success takes off the sent changes and clears the
+-- priority if there are no new ones, on failure counts a send error
+function push_DevSent(dev_id, sent_count, ok)
+	local res = RES_OK
+
+	box.begin()
+
+	local t_dev
+	if ok == 1
+	then
+		-- change_count
+		t_dev = space_devs:update(dev_id, {{'-', 7, sent_count}})
+		if t_dev ~= nil and t_dev[7] <= 0
+		then
+			space_devs:update(dev_id, {
+				-- change_count
+				{'=', 7, 0},
+				-- change_priority
+				{'=', 8, 0}})
+		end
+	else
+		-- send_error_count
+		t_dev = space_devs:update(dev_id, {{'+', 9, 1}})
+	end
+
+	box.commit()
+
+	if t_dev == nil
+	then
+		res = RES_ERR_UNKNOWN_DEV_ID
+	end
+
+	return res
+end
+
+--[[
+List subs of a device
+--]]
+
+function push_ListSubs(dev_id)
+	if space_devs:get(dev_id) == nil
+	then
+		return {RES_ERR_UNKNOWN_DEV_ID}
+	end
+
+	return {RES_OK, space_subs.index.dev_id:select{dev_id}}
+end
@@ -48,20 +48,20 @@ func (r *ResultCode) String() string {
 
 /* ----- */
 
-func genRandomString(keylen int) string {
+func genRandomString(r *rand.Rand, keylen int) string {
 	l := len(HEX_LETTERS_DIGITS)
 	b := make([]byte, keylen)
 	for i := 0; i < keylen; i++ {
-		b[i] = HEX_LETTERS_DIGITS[rand.Intn(l)]
+		b[i] = HEX_LETTERS_DIGITS[r.Intn(l)]
 	}
 	return string(b)
 }
 
-func genPushToken() string {
+func genPushToken(r *rand.Rand) string {
 	l := len(HEX_LETTERS_DIGITS)
 	b := make([]byte, 160)
 	for i := 0; i < 40; i++ {
-		v := HEX_LETTERS_DIGITS[rand.Intn(l)]
+		v := HEX_LETTERS_DIGITS[r.Intn(l)]
 		b[i] = v
 		b[i+40] = v
 		b[i+80] = v
@@ -373,6 +373,292 @@ func decodeResultEnt(d *msgpack.Decoder, v reflect.Value) error {
 	return nil
 }
 
+// One batch of push_SweepSubs, and the cursor to continue from
+type SweepResultEnt struct {
+	swept     int
+	scanned   int
+	next_ts   Millitime
+	next_skip int
+	done      bool
+}
+
+func (res SweepResultEnt) String() string {
+	return fmt.Sprintf("[swept = %d, scanned = %d, next_ts = %s, next_skip = %d, done = %t]",
+		res.swept, res.scanned, milliTimeFormat(res.next_ts), res.next_skip, res.done)
+}
+
+func encodeSweepResultEnt(e *msgpack.Encoder, v reflect.Value) error {
+	m := v.Interface().(SweepResultEnt)
+	if err := e.EncodeSliceLen(5); err != nil {
+		return err
+	}
+	if err := e.EncodeInt(m.swept); err != nil {
+		return err
+	}
+	if err := e.EncodeInt(m.scanned); err != nil {
+		return err
+	}
+	if err := e.EncodeInt64(int64(m.next_ts)); err != nil {
+		return err
+	}
+	if err := e.EncodeInt(m.next_skip); err != nil {
+		return err
+	}
+	done := 0
+	if m.done {
+		done = 1
+	}
+	if err := e.EncodeInt(done); err != nil {
+		return err
+	}
+	return nil
+}
+
+func decodeSweepResultEnt(d *msgpack.Decoder, v reflect.Value) error {
+	var err error
+	var l int
+	m := v.Addr().Interface().(*SweepResultEnt)
+	if l, err = d.DecodeSliceLen(); err != nil {
+		return err
+	}
+	if l != 5 {
+		return fmt.Errorf("decodeSweepResultEnt array len doesn't match: %d", l)
+	}
+	if m.swept, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	if m.scanned, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	if next_ts, err := d.DecodeInt64(); err != nil {
+		return err
+	} else {
+		m.next_ts = Millitime(next_ts)
+	}
+	if m.next_skip, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	var done int
+	if done, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	m.done = done != 0
+	return nil
+}
+
+// One batch of push_PurgeDevs: the devices purged, or with dry run the ones
+// which would be, and the cursor to continue from
+// ping_ts is the latest of the device's and its subs', kept when that is recent
+type PurgedDevEnt struct {
+	dev_id  string
+	ping_ts Millitime
+	subs    int
+	kept    bool
+}
+
+type PurgeResultEnt struct {
+	devs      int
+	subs      int
+	next_ts   Millitime
+	next_skip int
+	done      bool
+	list      []PurgedDevEnt
+}
+
+func (res PurgeResultEnt) String() string {
+	return fmt.Sprintf("[devs = %d, subs = %d, next_ts = %s, next_skip = %d, done = %t]",
+		res.devs, res.subs, milliTimeFormat(res.next_ts), res.next_skip, res.done)
+}
+
+func encodePurgeResultEnt(e *msgpack.Encoder, v reflect.Value) error {
+	m := v.Interface().(PurgeResultEnt)
+	if err := e.EncodeSliceLen(6); err != nil {
+		return err
+	}
+	if err := e.EncodeInt(m.devs); err != nil {
+		return err
+	}
+	if err := e.EncodeInt(m.subs); err != nil {
+		return err
+	}
+	if err := e.EncodeInt64(int64(m.next_ts)); err != nil {
+		return err
+	}
+	if err := e.EncodeInt(m.next_skip); err != nil {
+		return err
+	}
+	done := 0
+	if m.done {
+		done = 1
+	}
+	if err := e.EncodeInt(done); err != nil {
+		return err
+	}
+	if err := e.EncodeSliceLen(len(m.list)); err != nil {
+		return err
+	}
+	for _, item := range m.list {
+		if err := e.EncodeSliceLen(4); err != nil {
+			return err
+		}
+		if err := e.EncodeString(item.dev_id); err != nil {
+			return err
+		}
+		if err := e.EncodeInt64(int64(item.ping_ts)); err != nil {
+			return err
+		}
+		if err := e.EncodeInt(item.subs); err != nil {
+			return err
+		}
+		kept := 0
+		if item.kept {
+			kept = 1
+		}
+		if err := e.EncodeInt(kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodePurgeResultEnt(d *msgpack.Decoder, v reflect.Value) error {
+	var err error
+	var l int
+	m := v.Addr().Interface().(*PurgeResultEnt)
+	if l, err = d.DecodeSliceLen(); err != nil {
+		return err
+	}
+	if l != 6 {
+		return fmt.Errorf("decodePurgeResultEnt array len doesn't match: %d", l)
+	}
+	if m.devs, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	if m.subs, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	if next_ts, err := d.DecodeInt64(); err != nil {
+		return err
+	} else {
+		m.next_ts = Millitime(next_ts)
+	}
+	if m.next_skip, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	var done int
+	if done, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	m.done = done != 0
+	if l, err = d.DecodeSliceLen(); err != nil {
+		return err
+	}
+	m.list = make([]PurgedDevEnt, l)
+	for i := range m.list {
+		item := &m.list[i]
+		if l, err = d.DecodeSliceLen(); err != nil {
+			return err
+		}
+		if l != 4 {
+			return fmt.Errorf("decodePurgeResultEnt item array len doesn't match: %d", l)
+		}
+		if item.dev_id, err = d.DecodeString(); err != nil {
+			return err
+		}
+		if ping_ts, err := d.DecodeInt64(); err != nil {
+			return err
+		} else {
+			item.ping_ts = Millitime(ping_ts)
+		}
+		if item.subs, err = d.DecodeInt(); err != nil {
+			return err
+		}
+		var kept int
+		if kept, err = d.DecodeInt(); err != nil {
+			return err
+		}
+		item.kept = kept != 0
+	}
+	return nil
+}
+
+// One batch of push_TakeDueDevs: the leased devices and the cursor to continue from
+type DueDevsResultEnt struct {
+	next_ts   Millitime
+	next_skip int
+	done      bool
+	devs      []DevEnt
+}
+
+func (res DueDevsResultEnt) String() string {
+	return fmt.Sprintf("[next_ts = %s, next_skip = %d, done = %t, devs = %d]",
+		milliTimeFormat(res.next_ts), res.next_skip, res.done, len(res.devs))
+}
+
+func encodeDueDevsResultEnt(e *msgpack.Encoder, v reflect.Value) error {
+	m := v.Interface().(DueDevsResultEnt)
+	if err := e.EncodeSliceLen(4); err != nil {
+		return err
+	}
+	if err := e.EncodeInt64(int64(m.next_ts)); err != nil {
+		return err
+	}
+	if err := e.EncodeInt(m.next_skip); err != nil {
+		return err
+	}
+	done := 0
+	if m.done {
+		done = 1
+	}
+	if err := e.EncodeInt(done); err != nil {
+		return err
+	}
+	if err := e.EncodeSliceLen(len(m.devs)); err != nil {
+		return err
+	}
+	for _, dev := range m.devs {
+		if err := e.Encode(dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeDueDevsResultEnt(d *msgpack.Decoder, v reflect.Value) error {
+	var err error
+	var l int
+	m := v.Addr().Interface().(*DueDevsResultEnt)
+	if l, err = d.DecodeSliceLen(); err != nil {
+		return err
+	}
+	if l != 4 {
+		return fmt.Errorf("decodeDueDevsResultEnt array len doesn't match: %d", l)
+	}
+	if next_ts, err := d.DecodeInt64(); err != nil {
+		return err
+	} else {
+		m.next_ts = Millitime(next_ts)
+	}
+	if m.next_skip, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	var done int
+	if done, err = d.DecodeInt(); err != nil {
+		return err
+	}
+	m.done = done != 0
+	if l, err = d.DecodeSliceLen(); err != nil {
+		return err
+	}
+	m.devs = make([]DevEnt, l)
+	for i := range m.devs {
+		if err := d.Decode(&m.devs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type ResultSubListEnt struct {
 	code ResultCode
 	subs []SubEnt
@@ -447,6 +733,27 @@ func init() {
 	msgpack.Register(reflect.TypeOf(SubEnt{}), encodeSubEnt, decodeSubEnt)
 	msgpack.Register(reflect.TypeOf(ResultEnt{}), encodeResultEnt, decodeResultEnt)
 	msgpack.Register(reflect.TypeOf(ResultSubListEnt{}), encodeResultSubListEnt, decodeResultSubListEnt)
+	msgpack.Register(reflect.TypeOf(SweepResultEnt{}), encodeSweepResultEnt, decodeSweepResultEnt)
+	msgpack.Register(reflect.TypeOf(PurgeResultEnt{}), encodePurgeResultEnt, decodePurgeResultEnt)
+	msgpack.Register(reflect.TypeOf(DueDevsResultEnt{}), encodeDueDevsResultEnt, decodeDueDevsResultEnt)
+}
+
+/* ----- */
+
+// Error from a database call which keeps the connector's error, so callers can
+// tell timeouts and connection failures from other errors
+
+type PushDbError struct {
+	msg   string
+	cause error
+}
+
+func newPushDbError(msg string, cause error) error {
+	return &PushDbError{msg: msg, cause: cause}
+}
+
+func (e *PushDbError) Error() string {
+	return e.msg
 }
 
 /* ----- */
@@ -466,7 +773,7 @@ func (model *PushDbModel) getDevEnt(dev_id string) (*DevEnt, error) {
 	err := model.dbconn.SelectTyped("devs", "primary", 0, 1, tarantool.IterEq, []interface{}{dev_id}, &res)
 	if err != nil {
 		s := fmt.Sprintf("Error calling device select: %s", err)
-		return nil, errors.New(s)
+		return nil, newPushDbError(s, err)
 	}
 
 	if res == nil {
@@ -488,7 +795,7 @@ func (model *PushDbModel) doCreateDev(dev_id string, auth string, push_token str
 	err := model.dbconn.CallTyped(fname, []interface{}{dev_id, auth, push_token, push_tech, now}, &res)
 	if err != nil {
 		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
-		return nil, RES_ERR_DATABASE, errors.New(s)
+		return nil, RES_ERR_DATABASE, newPushDbError(s, err)
 	}
 
 	if res == nil || len(res) != 1 {
@@ -506,7 +813,7 @@ func (model *PushDbModel) doCreateSub(dev_id string, folder_id string, sub_id st
 	err := model.dbconn.CallTyped(fname, []interface{}{dev_id, folder_id, sub_id, now}, &res)
 	if err != nil {
 		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
-		return RES_ERR_DATABASE, errors.New(s)
+		return RES_ERR_DATABASE, newPushDbError(s, err)
 	}
 	if res == nil || len(res) != 1 {
 		s := fmt.Sprintf("Error calling %s: result set", fname)
@@ -524,7 +831,7 @@ func (model *PushDbModel) doPingSub(dev_id string, folder_id string, sub_id stri
 	err := model.dbconn.CallTyped(fname, []interface{}{dev_id, folder_id, sub_id, now}, &res)
 	if err != nil {
 		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
-		return RES_ERR_DATABASE, errors.New(s)
+		return RES_ERR_DATABASE, newPushDbError(s, err)
 	}
 	if res == nil || len(res) != 1 {
 		s := fmt.Sprintf("Error calling %s: result set", fname)
@@ -547,8 +854,26 @@ func (model *PushDbModel) doChangeSub(dev_id string, folder_id string, sub_id st
 	err := model.dbconn.CallTyped(fname, []interface{}{dev_id, folder_id, sub_id, now, delta, pint}, &res)
 	if err != nil {
 		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
+		return RES_ERR_DATABASE, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", fname)
 		return RES_ERR_DATABASE, errors.New(s)
 	}
+
+	return res[0].code, nil
+}
+
+func (model *PushDbModel) doDeleteSub(dev_id string, folder_id string, sub_id string) (ResultCode, error) {
+	var fname = "push_DeleteSub"
+
+	var res []ResultEnt
+
+	err := model.dbconn.CallTyped(fname, []interface{}{dev_id, folder_id, sub_id}, &res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
+		return RES_ERR_DATABASE, newPushDbError(s, err)
+	}
 	if res == nil || len(res) != 1 {
 		s := fmt.Sprintf("Error calling %s: result set", fname)
 		return RES_ERR_DATABASE, errors.New(s)
@@ -556,3 +881,188 @@ func (model *PushDbModel) doChangeSub(dev_id string, folder_id string, sub_id st
 
 	return res[0].code, nil
 }
+
+// Deletes the device and all of its subs
+func (model *PushDbModel) doDeleteDev(dev_id string) (ResultCode, error) {
+	var fname = "push_DeleteDev"
+
+	var res []ResultEnt
+
+	err := model.dbconn.CallTyped(fname, []interface{}{dev_id}, &res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
+		return RES_ERR_DATABASE, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", fname)
+		return RES_ERR_DATABASE, errors.New(s)
+	}
+
+	return res[0].code, nil
+}
+
+// One batch of the stale sub sweep, starting at the cursor
+func (model *PushDbModel) doSweepSubs(cursor_ts Millitime, cursor_skip int, before_ts Millitime, batch int) (*SweepResultEnt, error) {
+	var fname = "push_SweepSubs"
+
+	var res []SweepResultEnt
+
+	err := model.dbconn.CallTyped(fname, []interface{}{cursor_ts, cursor_skip, before_ts, batch}, &res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
+		return nil, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", fname)
+		return nil, errors.New(s)
+	}
+
+	return &res[0], nil
+}
+
+// One batch of the inactive device purge, starting at the cursor
+func (model *PushDbModel) doPurgeDevs(cursor_ts Millitime, cursor_skip int, before_ts Millitime, batch int, dry_run bool) (*PurgeResultEnt, error) {
+	var fname = "push_PurgeDevs"
+
+	dint := 0
+	if dry_run {
+		dint = 1
+	}
+
+	var res []PurgeResultEnt
+
+	err := model.dbconn.CallTyped(fname, []interface{}{cursor_ts, cursor_skip, before_ts, batch, dint}, &res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
+		return nil, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", fname)
+		return nil, errors.New(s)
+	}
+
+	return &res[0], nil
+}
+
+// Takes and leases one batch of devices with pending changes, starting at the cursor
+func (model *PushDbModel) doTakeDueDevs(cursor_ts Millitime, cursor_skip int, now Millitime, batch int, lease Millitime) (*DueDevsResultEnt, error) {
+	var fname = "push_TakeDueDevs"
+
+	var res []DueDevsResultEnt
+
+	err := model.dbconn.CallTyped(fname, []interface{}{cursor_ts, cursor_skip, now, batch, lease}, &res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
+		return nil, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", fname)
+		return nil, errors.New(s)
+	}
+
+	return &res[0], nil
+}
+
+// Reports a send of sent_count changes, resetting the device's change_count
+// and change_priority on success
+func (model *PushDbModel) doDevSent(dev_id string, sent_count int, ok bool) (ResultCode, error) {
+	var fname = "push_DevSent"
+
+	oint := 0
+	if ok {
+		oint = 1
+	}
+
+	var res []ResultEnt
+
+	err := model.dbconn.CallTyped(fname, []interface{}{dev_id, sent_count, oint}, &res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
+		return RES_ERR_DATABASE, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", fname)
+		return RES_ERR_DATABASE, errors.New(s)
+	}
+
+	return res[0].code, nil
+}
+
+func (model *PushDbModel) doListSubs(dev_id string) (*ResultSubListEnt, ResultCode, error) {
+	var fname = "push_ListSubs"
+
+	var res []ResultSubListEnt
+
+	err := model.dbconn.CallTyped(fname, []interface{}{dev_id}, &res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", fname, err.Error())
+		return nil, RES_ERR_DATABASE, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", fname)
+		return nil, RES_ERR_DATABASE, errors.New(s)
+	}
+
+	return &res[0], res[0].code, nil
+}
+
+/* ----- */
+
+// Asynchronous calls: the request is sent right away, the result is read
+// later with one of the get methods
+
+type PushDbFuture struct {
+	fname  string
+	future *tarantool.Future
+}
+
+func (model *PushDbModel) callAsync(fname string, args []interface{}) *PushDbFuture {
+	return &PushDbFuture{fname: fname, future: model.dbconn.CallAsync(fname, args)}
+}
+
+func (f *PushDbFuture) getResultCode() (ResultCode, error) {
+	var res []ResultEnt
+	err := f.future.GetTyped(&res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", f.fname, err.Error())
+		return RES_ERR_DATABASE, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", f.fname)
+		return RES_ERR_DATABASE, errors.New(s)
+	}
+
+	return res[0].code, nil
+}
+
+func (f *PushDbFuture) getSubList() (*ResultSubListEnt, ResultCode, error) {
+	var res []ResultSubListEnt
+	err := f.future.GetTyped(&res)
+	if err != nil {
+		s := fmt.Sprintf("Error calling %s: %s", f.fname, err.Error())
+		return nil, RES_ERR_DATABASE, newPushDbError(s, err)
+	}
+	if res == nil || len(res) != 1 {
+		s := fmt.Sprintf("Error calling %s: result set", f.fname)
+		return nil, RES_ERR_DATABASE, errors.New(s)
+	}
+
+	return &res[0], res[0].code, nil
+}
+
+func (model *PushDbModel) doPingSubAsync(dev_id string, folder_id string, sub_id string, now Millitime) *PushDbFuture {
+	return model.callAsync("push_PingSub", []interface{}{dev_id, folder_id, sub_id, now})
+}
+
+func (model *PushDbModel) doChangeSubAsync(dev_id string, folder_id string, sub_id string, now Millitime, delta Millitime, priority bool) *PushDbFuture {
+	pint := 0
+	if priority {
+		pint = 1
+	}
+
+	return model.callAsync("push_ChangeSub", []interface{}{dev_id, folder_id, sub_id, now, delta, pint})
+}
+
+func (model *PushDbModel) doListSubsAsync(dev_id string) *PushDbFuture {
+	return model.callAsync("push_ListSubs", []interface{}{dev_id})
+}
@@ -4,4 +4,23 @@ go run \
 	test_db_server.go \
 	push_config.go \
 	push_db_util.go \
+	test_db_latency.go \
+	test_db_pacer.go \
+	test_db_mix.go \
+	test_db_keydist.go \
+	test_db_pipeline.go \
+	test_db_report.go \
+	test_db_compare.go \
+	test_db_cliff.go \
+	test_db_progress.go \
+	test_db_metrics.go \
+	test_db_serverstats.go \
+	test_db_errors.go \
+	test_db_keyfile.go \
+	test_db_scenario.go \
+	test_db_sim.go \
+	test_db_churn.go \
+	test_db_sweeper.go \
+	test_db_purge.go \
+	test_db_dispatcher.go \
 	$@
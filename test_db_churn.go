@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tarantool/go-tarantool"
+)
+
+/* ----- */
+
+// Churn: devices come and go, to see what steady creation and deletion does to
+// the server's memory and throughput over time. Each worker only deletes the
+// devices and subs it created itself, so the key pool used by ping and change
+// stays valid.
+//
+//	create  - a new device with CHURN_FOLDERS subs
+//	delsub  - one sub of one of the worker's devices
+//	deldev  - one of the worker's devices, with its subs
+
+const (
+	CHURN_CREATE  = "create"
+	CHURN_DEL_SUB = "delsub"
+	CHURN_DEL_DEV = "deldev"
+
+	CHURN_DEFAULT = "create=50,delsub=15,deldev=35"
+
+	CHURN_FOLDERS = 3
+)
+
+func parseChurnWeights(s string) (*MixWeights, error) {
+	return parseWeights(s, []string{CHURN_CREATE, CHURN_DEL_SUB, CHURN_DEL_DEV})
+}
+
+type ChurnDevice struct {
+	dev_id  string
+	folders []DevFolderSub
+}
+
+func newRunFuncChurn(churn *MixWeights) WorkerFunc {
+	return func(client *tarantool.Connection, keylen int, numreq int, p *Worker) {
+		runFuncChurn(churn, client, keylen, numreq, p)
+	}
+}
+
+func runFuncChurn(churn *MixWeights, client *tarantool.Connection, keylen int, numreq int, p *Worker) {
+	model := NewPushDbModel(client)
+
+	var devs []*ChurnDevice
+
+	for i := 0; p.more(i, numreq); i++ {
+		name := churn.pick(p.rnd)
+		if len(devs) == 0 {
+			// Nothing to delete yet
+			name = CHURN_CREATE
+		}
+
+		ok := false
+		switch name {
+		case CHURN_CREATE:
+			var d *ChurnDevice
+			if d, ok = churnCreateDev(model, keylen, p); d != nil {
+				devs = append(devs, d)
+			}
+		case CHURN_DEL_SUB:
+			index := p.rnd.Intn(len(devs))
+			d := devs[index]
+			if len(d.folders) == 0 {
+				ok = churnDeleteDev(model, d, p)
+				devs = removeChurnDevice(devs, index)
+				break
+			}
+			n := p.rnd.Intn(len(d.folders))
+			ent := d.folders[n]
+			if ok = churnDeleteSub(model, ent, p); ok {
+				d.folders[n] = d.folders[len(d.folders)-1]
+				d.folders = d.folders[:len(d.folders)-1]
+			}
+		case CHURN_DEL_DEV:
+			index := p.rnd.Intn(len(devs))
+			if ok = churnDeleteDev(model, devs[index], p); ok {
+				devs = removeChurnDevice(devs, index)
+			}
+		}
+
+		if ok {
+			p.increment()
+		}
+	}
+}
+
+func removeChurnDevice(devs []*ChurnDevice, index int) []*ChurnDevice {
+	last := len(devs) - 1
+	devs[index] = devs[last]
+	devs[last] = nil
+	return devs[:last]
+}
+
+// Each returns false if a call failed
+
+// Returns the device if it was created, even if some of its subs were not
+func churnCreateDev(model *PushDbModel, keylen int, p *Worker) (*ChurnDevice, bool) {
+	dev_id := genRandomString(p.rnd, keylen)
+	auth := genRandomString(p.rnd, AUTH_STRING_LEN)
+	push_token := genPushToken(p.rnd)
+	now := milliTime()
+
+	// Model
+	start := p.begin()
+	t_dev, code, err := model.doCreateDev(dev_id, auth, push_token, PUSH_TECH_GCM_DEBUG, now)
+	p.observe(OP_CREATE_DEV, start)
+	if t_dev == nil || code != RES_OK || err != nil {
+		p.failed(code, err)
+		return nil, false
+	}
+
+	d := &ChurnDevice{dev_id: dev_id, folders: make([]DevFolderSub, 0, CHURN_FOLDERS)}
+
+	for i := 0; i < CHURN_FOLDERS; i++ {
+		folder_id := fmt.Sprintf("%08d", i)
+		sub_id := genRandomString(p.rnd, keylen)
+
+		// Model
+		start = p.begin()
+		code, err = model.doCreateSub(dev_id, folder_id, sub_id, now)
+		p.observe(OP_CREATE_SUB, start)
+		if code != RES_OK || err != nil {
+			p.failed(code, err)
+			return d, false
+		}
+
+		d.folders = append(d.folders, NewDevFolderSub_Vars(dev_id, folder_id, sub_id))
+	}
+
+	return d, true
+}
+
+func churnDeleteSub(model *PushDbModel, ent DevFolderSub, p *Worker) bool {
+	// Model
+	start := p.begin()
+	code, err := model.doDeleteSub(ent.dev_id, ent.folder_id, ent.sub_id)
+	p.observe(OP_DELETE_SUB, start)
+	if code != RES_OK || err != nil {
+		p.failed(code, err)
+		return false
+	}
+	return true
+}
+
+func churnDeleteDev(model *PushDbModel, d *ChurnDevice, p *Worker) bool {
+	// Model
+	start := p.begin()
+	code, err := model.doDeleteDev(d.dev_id)
+	p.observe(OP_DELETE_DEV, start)
+	if code != RES_OK || err != nil {
+		p.failed(code, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/* ----- */
+
+// Change point detection over the per-interval rps series: a cliff starts when
+// rps stays below the baseline by more than pct percent for at least the
+// configured duration, and ends when it stays above that level as long.
+// The baseline is the mean of recent intervals outside of any drop.
+
+const (
+	CLIFF_BASELINE_MIN = 3
+	CLIFF_BASELINE_MAX = 10
+)
+
+type CliffEvent struct {
+	Started       time.Time `json:"started"`
+	StartRequests int64     `json:"start_requests"`
+	Ended         time.Time `json:"ended"`
+	EndRequests   int64     `json:"end_requests"`
+	Baseline      float64   `json:"baseline_rps"`
+	MinRps        float64   `json:"min_rps"`
+	MeanRps       float64   `json:"mean_rps"`
+
+	sum   float64
+	count int
+}
+
+type CliffDetector struct {
+	pct      float64
+	duration time.Duration
+
+	baseline []float64
+
+	// A drop (or a recovery from one) which has not lasted long enough yet
+	pending_since    time.Time
+	pending_requests int64
+	pending          []float64
+
+	active *CliffEvent
+	events []CliffEvent
+}
+
+func NewCliffDetector(pct float64, duration time.Duration) *CliffDetector {
+	return &CliffDetector{pct: pct, duration: duration}
+}
+
+// Adds one interval which started at since with since_requests completed
+func (d *CliffDetector) add(since time.Time, since_requests int64, now time.Time, requests int64, rps float64) {
+	if d == nil {
+		return
+	}
+
+	if len(d.baseline) < CLIFF_BASELINE_MIN {
+		d.addBaseline(rps)
+		return
+	}
+
+	base := meanOf(d.baseline)
+	low := rps < base*(1-d.pct/100)
+	if d.active != nil {
+		low = rps < d.active.Baseline*(1-d.pct/100)
+	}
+
+	// Looking for a drop if not in one, for a recovery otherwise
+	change := low
+	if d.active != nil {
+		change = !low
+	}
+
+	if !change {
+		d.pending = d.pending[:0]
+		if d.active != nil {
+			d.active.addRps(rps)
+		} else {
+			d.addBaseline(rps)
+		}
+		return
+	}
+
+	if len(d.pending) == 0 {
+		d.pending_since = since
+		d.pending_requests = since_requests
+	}
+	d.pending = append(d.pending, rps)
+
+	if now.Sub(d.pending_since) < d.duration {
+		return
+	}
+
+	if d.active == nil {
+		d.active = &CliffEvent{
+			Started:       d.pending_since,
+			StartRequests: d.pending_requests,
+			Baseline:      base,
+			MinRps:        rps}
+		for _, v := range d.pending {
+			d.active.addRps(v)
+		}
+		log.Printf("Throughput cliff at %d requests, %s: %.2f rps, baseline %.2f rps\n",
+			d.active.StartRequests, d.active.Started.Format("15:04:05.000"), d.active.MeanRps, base)
+	} else {
+		d.active.Ended = d.pending_since
+		d.active.EndRequests = d.pending_requests
+		log.Printf("Throughput recovered at %d requests, %s: %.2f rps, baseline %.2f rps\n",
+			d.active.EndRequests, d.active.Ended.Format("15:04:05.000"), rps, d.active.Baseline)
+
+		d.events = append(d.events, *d.active)
+		d.active = nil
+		d.baseline = append(d.baseline[:0], d.pending...)
+	}
+
+	d.pending = d.pending[:0]
+}
+
+func (d *CliffDetector) addBaseline(rps float64) {
+	d.baseline = append(d.baseline, rps)
+	if len(d.baseline) > CLIFF_BASELINE_MAX {
+		d.baseline = d.baseline[1:]
+	}
+}
+
+func (e *CliffEvent) addRps(rps float64) {
+	e.sum += rps
+	e.count++
+	e.MeanRps = e.sum / float64(e.count)
+	if rps < e.MinRps {
+		e.MinRps = rps
+	}
+}
+
+// All events including one still in progress, which has a zero end time
+func (d *CliffDetector) allEvents() []CliffEvent {
+	if d == nil {
+		return nil
+	}
+	res := append([]CliffEvent(nil), d.events...)
+	if d.active != nil {
+		res = append(res, *d.active)
+	}
+	return res
+}
+
+func logCliffs(events []CliffEvent) {
+	for _, e := range events {
+		end := "not recovered"
+		if !e.Ended.IsZero() {
+			end = "recovered at " + e.Ended.Format("15:04:05.000") + " after " + e.Ended.Sub(e.Started).String()
+		}
+		log.Printf("    cliff at %d requests, %s: %.2f -> %.2f rps (min %.2f), %s\n",
+			e.StartRequests, e.Started.Format("15:04:05.000"), e.Baseline, e.MeanRps, e.MinRps, end)
+	}
+}
+
+func meanOf(v []float64) float64 {
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	return sum / float64(len(v))
+}
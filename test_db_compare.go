@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+/* ----- */
+
+// Compares two runs saved with -out (JSON): commands are aligned by scenario
+// phase, name, connection count and order, intervals by their index. A regression is a
+// change for the worse by more than the threshold percentage which is also
+// significant by Welch's t-test over the interval samples.
+
+// Exit codes of the compare command, for nightly jobs
+const (
+	COMPARE_EXIT_OK         = 0
+	COMPARE_EXIT_REGRESSION = 1
+	COMPARE_EXIT_ERROR      = 2
+)
+
+type CompareFlags struct {
+	threshold float64
+	alpha     float64
+}
+
+func loadRunReport(path string) (*RunReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r RunReport
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &r, nil
+}
+
+// Returns the process exit code: COMPARE_EXIT_REGRESSION when there are
+// regressions, COMPARE_EXIT_ERROR when the results can't be loaded
+func runCompare(cflags CompareFlags, path_a string, path_b string) int {
+	a, err := loadRunReport(path_a)
+	if err != nil {
+		fmt.Printf("Error loading results: %s\n", err)
+		return COMPARE_EXIT_ERROR
+	}
+	b, err := loadRunReport(path_b)
+	if err != nil {
+		fmt.Printf("Error loading results: %s\n", err)
+		return COMPARE_EXIT_ERROR
+	}
+
+	fmt.Printf("A: %s (%s)\n", path_a, a.Started.Format("2006-01-02 15:04:05"))
+	fmt.Printf("B: %s (%s)\n", path_b, b.Started.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Regression threshold: %.1f%%, alpha: %.3f\n", cflags.threshold, cflags.alpha)
+
+	regressions := 0
+	used := make([]bool, len(b.Commands))
+
+	for _, cmd_a := range a.Commands {
+		cmd_b := matchCommand(cmd_a, b.Commands, used)
+		if cmd_b == nil {
+			fmt.Printf("\n%s (conns = %d): missing in B\n", commandLabel(cmd_a), cmd_a.Conns)
+			continue
+		}
+
+		regressions += compareCommands(cflags, cmd_a, cmd_b)
+	}
+
+	for i, cmd_b := range b.Commands {
+		if !used[i] {
+			fmt.Printf("\n%s (conns = %d): missing in A\n", commandLabel(cmd_b), cmd_b.Conns)
+		}
+	}
+
+	fmt.Println()
+	if regressions > 0 {
+		fmt.Printf("Found %d regression(s)\n", regressions)
+		return COMPARE_EXIT_REGRESSION
+	}
+
+	fmt.Printf("No regressions\n")
+	return COMPARE_EXIT_OK
+}
+
+func matchCommand(cmd *CommandReport, list []*CommandReport, used []bool) *CommandReport {
+	for i, other := range list {
+		if !used[i] && other.Phase == cmd.Phase && other.Name == cmd.Name && other.Conns == cmd.Conns {
+			used[i] = true
+			return other
+		}
+	}
+	return nil
+}
+
+// Scenario runs can repeat a workload, the phase tells them apart
+func commandLabel(cmd *CommandReport) string {
+	if cmd.Phase == "" {
+		return cmd.Name
+	}
+	return fmt.Sprintf("%s: %s", cmd.Phase, cmd.Name)
+}
+
+func compareCommands(cflags CompareFlags, a *CommandReport, b *CommandReport) int {
+	regressions := 0
+
+	fmt.Printf("\n%s (conns = %d, c = %d / %d)\n", commandLabel(a), a.Conns, a.Conc, b.Conc)
+	fmt.Printf("  %-22s %12s %12s %9s\n", "", "A", "B", "delta")
+
+	// Throughput, lower is worse
+	rps_a := intervalValues(a, func(in IntervalReport) (float64, bool) { return in.Rps, true })
+	rps_b := intervalValues(b, func(in IntervalReport) (float64, bool) { return in.Rps, true })
+	if comparePrint(cflags, "rps", a.Rps, b.Rps, rps_a, rps_b, false) {
+		regressions++
+	}
+
+	// Latencies, higher is worse
+	for _, op_a := range a.Ops {
+		op_b := findOpReport(b.Ops, op_a.Op)
+		if op_b == nil {
+			continue
+		}
+
+		name := op_a.Op
+		p99_a := intervalValues(a, intervalOpValue(name, func(op *OpReport) float64 { return op.P99 }))
+		p99_b := intervalValues(b, intervalOpValue(name, func(op *OpReport) float64 { return op.P99 }))
+
+		comparePrint(cflags, name+" rps", op_a.Rps, op_b.Rps, nil, nil, false)
+		comparePrint(cflags, name+" p50 ms", op_a.P50, op_b.P50, nil, nil, true)
+		if comparePrint(cflags, name+" p99 ms", op_a.P99, op_b.P99, p99_a, p99_b, true) {
+			regressions++
+		}
+		comparePrint(cflags, name+" max ms", op_a.Max, op_b.Max, nil, nil, true)
+	}
+
+	if len(a.Cliffs) != 0 || len(b.Cliffs) != 0 {
+		fmt.Printf("  %-22s %12d %12d\n", "throughput cliffs", len(a.Cliffs), len(b.Cliffs))
+	}
+
+	// Interval by interval
+	n := len(a.Intervals)
+	if len(b.Intervals) > n {
+		n = len(b.Intervals)
+	}
+	if n > 0 {
+		fmt.Printf("  %-8s %12s %12s %9s\n", "interval", "A rps", "B rps", "delta")
+	}
+	for i := 0; i < n; i++ {
+		var ra, rb string
+		var va, vb float64
+		if i < len(a.Intervals) {
+			va = a.Intervals[i].Rps
+			ra = fmt.Sprintf("%12.2f", va)
+		}
+		if i < len(b.Intervals) {
+			vb = b.Intervals[i].Rps
+			rb = fmt.Sprintf("%12.2f", vb)
+		}
+		delta := ""
+		if i < len(a.Intervals) && i < len(b.Intervals) {
+			delta = fmt.Sprintf("%+8.1f%%", percentChange(va, vb))
+		}
+		fmt.Printf("  %-8d %12s %12s %9s\n", i+1, ra, rb, delta)
+	}
+
+	return regressions
+}
+
+// Prints one metric and returns true if it is a significant regression
+func comparePrint(cflags CompareFlags, name string, a float64, b float64,
+	samples_a []float64, samples_b []float64, higher_is_worse bool) bool {
+
+	change := percentChange(a, b)
+	worse := change < -cflags.threshold
+	if higher_is_worse {
+		worse = change > cflags.threshold
+	}
+
+	mark := ""
+	regression := false
+	if samples_a != nil && samples_b != nil {
+		p := welchTTest(samples_a, samples_b)
+		if worse && p < cflags.alpha {
+			mark = fmt.Sprintf("  REGRESSION (p = %.4f)", p)
+			regression = true
+		} else if worse {
+			mark = fmt.Sprintf("  not significant (p = %.4f)", p)
+		}
+	}
+
+	fmt.Printf("  %-22s %12.3f %12.3f %+8.1f%%%s\n", name, a, b, change, mark)
+	return regression
+}
+
+func percentChange(a float64, b float64) float64 {
+	if a == 0 {
+		return 0
+	}
+	return (b - a) / a * 100
+}
+
+func findOpReport(ops []OpReport, name string) *OpReport {
+	for i := range ops {
+		if ops[i].Op == name {
+			return &ops[i]
+		}
+	}
+	return nil
+}
+
+func intervalValues(cmd *CommandReport, value func(IntervalReport) (float64, bool)) []float64 {
+	res := make([]float64, 0, len(cmd.Intervals))
+	for _, in := range cmd.Intervals {
+		if v, ok := value(in); ok {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func intervalOpValue(name string, value func(*OpReport) float64) func(IntervalReport) (float64, bool) {
+	return func(in IntervalReport) (float64, bool) {
+		op := findOpReport(in.Ops, name)
+		if op == nil {
+			return 0, false
+		}
+		return value(op), true
+	}
+}
+
+/* ----- */
+
+// Two sided p-value of Welch's t-test, 1 if there are too few samples
+
+func welchTTest(a []float64, b []float64) float64 {
+	if len(a) < 2 || len(b) < 2 {
+		return 1
+	}
+
+	mean_a, var_a := meanVariance(a)
+	mean_b, var_b := meanVariance(b)
+	na := float64(len(a))
+	nb := float64(len(b))
+
+	se2 := var_a/na + var_b/nb
+	if se2 == 0 {
+		if mean_a == mean_b {
+			return 1
+		}
+		return 0
+	}
+
+	t := (mean_a - mean_b) / math.Sqrt(se2)
+	df := se2 * se2 / (var_a*var_a/(na*na*(na-1)) + var_b*var_b/(nb*nb*(nb-1)))
+
+	// P(|T| > t) for Student's t with df degrees of freedom
+	return incompleteBeta(df/2, 0.5, df/(df+t*t))
+}
+
+func meanVariance(v []float64) (float64, float64) {
+	var sum float64
+	for _, x := range v {
+		sum += x
+	}
+	mean := sum / float64(len(v))
+
+	var sq float64
+	for _, x := range v {
+		sq += (x - mean) * (x - mean)
+	}
+	return mean, sq / float64(len(v)-1)
+}
+
+// Regularized incomplete beta function I_x(a, b)
+func incompleteBeta(a float64, b float64, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	lgab, _ := math.Lgamma(a + b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(a, b, x) / a
+	}
+	return 1 - front*betaContinuedFraction(b, a, 1-x)/b
+}
+
+func betaContinuedFraction(a float64, b float64, x float64) float64 {
+	const (
+		max_iter = 200
+		epsilon  = 3e-14
+		tiny     = 1e-300
+	)
+
+	c := 1.0
+	d := 1 - (a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+
+	for m := 1; m <= max_iter; m++ {
+		fm := float64(m)
+
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		num = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+
+	return h
+}
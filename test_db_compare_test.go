@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+/* ----- */
+
+// Reference p-values are two sided tail probabilities of Student's t
+// distribution, from numeric integration of its density
+
+const P_VALUE_EPSILON = 1e-6
+
+func TestIncompleteBeta(t *testing.T) {
+	tests := []struct {
+		a, b, x float64
+		want    float64
+	}{
+		// Edges
+		{2, 3, 0, 0},
+		{2, 3, 1, 1},
+		{2, 3, -0.5, 0},
+		{2, 3, 1.5, 1},
+		// I_x(a, 1) = x^a
+		{3, 1, 0.4, math.Pow(0.4, 3)},
+		{0.5, 1, 0.9, math.Sqrt(0.9)},
+		// I_x(1, b) = 1 - (1 - x)^b
+		{1, 4, 0.3, 1 - math.Pow(0.7, 4)},
+		{1, 2.5, 0.8, 1 - math.Pow(0.2, 2.5)},
+		// I_0.5(a, a) = 0.5
+		{7, 7, 0.5, 0.5},
+		{0.5, 0.5, 0.5, 0.5},
+		// Integer a and b, from the binomial sum over j = a..a+b-1 of
+		// C(a+b-1, j) x^j (1-x)^(a+b-1-j), on both sides of the continued
+		// fraction switch at x = (a+1)/(a+b+2)
+		{2, 5, 0.2, 0.34464},
+		{3, 4, 0.35, 0.35291484375},
+		{5, 2, 0.9, 0.885735},
+	}
+
+	for _, tt := range tests {
+		got := incompleteBeta(tt.a, tt.b, tt.x)
+		if math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("incompleteBeta(%g, %g, %g) = %.15f, want %.15f", tt.a, tt.b, tt.x, got, tt.want)
+		}
+	}
+}
+
+// P(|T| > t) the same way welchTTest gets it
+func studentTwoSided(t float64, df float64) float64 {
+	return incompleteBeta(df/2, 0.5, df/(df+t*t))
+}
+
+func TestStudentTwoSided(t *testing.T) {
+	tests := []struct {
+		t, df float64
+		want  float64
+	}{
+		{0, 5, 1},
+		{1, 1, 0.5},
+		{12.706, 1, 0.0500008024},
+		{4.303, 2, 0.0499925250},
+		{6, 3, 0.0092727149},
+		{0.5, 5, 0.6382988716},
+		{2, 8, 0.0805162380},
+		{2.228, 10, 0.0500117718},
+		{3.169, 10, 0.0100046334},
+		{2.042, 30, 0.0500286707},
+		{-2.042, 30, 0.0500286707},
+	}
+
+	for _, tt := range tests {
+		got := studentTwoSided(tt.t, tt.df)
+		if math.Abs(got-tt.want) > P_VALUE_EPSILON {
+			t.Errorf("t = %g, df = %g: p = %.10f, want %.10f", tt.t, tt.df, got, tt.want)
+		}
+	}
+}
+
+func TestWelchTTest(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		// Equal variances and sizes: t = -2, df = 8
+		{"equal variances", []float64{1, 2, 3, 4, 5}, []float64{3, 4, 5, 6, 7}, 0.0805162380},
+		// t = -3.417, df = 9.369
+		{"unequal variances", []float64{10, 12, 11, 13, 9, 12}, []float64{14, 20, 9, 17, 15, 22, 18, 16}, 0.0072261540},
+		// t = -0.635, df = 3.799
+		{"not significant", []float64{100, 101, 99, 100}, []float64{100, 102, 98, 103}, 0.5617632598},
+		// One side has no variance: t = -0.775, df = 3
+		{"one constant", []float64{5, 5, 5}, []float64{4, 6, 5, 7}, 0.4950253461},
+
+		// Too few samples
+		{"empty", nil, nil, 1},
+		{"one sample a", []float64{1}, []float64{1, 2, 3}, 1},
+		{"one sample b", []float64{1, 2, 3}, []float64{7}, 1},
+
+		// Zero variance on both sides
+		{"constant equal", []float64{4, 4, 4}, []float64{4, 4}, 1},
+		{"constant different", []float64{4, 4, 4}, []float64{5, 5}, 0},
+	}
+
+	for _, tt := range tests {
+		got := welchTTest(tt.a, tt.b)
+		if math.Abs(got-tt.want) > P_VALUE_EPSILON {
+			t.Errorf("%s: p = %.10f, want %.10f", tt.name, got, tt.want)
+		}
+		if back := welchTTest(tt.b, tt.a); math.Abs(back-got) > 1e-12 {
+			t.Errorf("%s: p = %.10f with a and b swapped, %.10f otherwise", tt.name, back, got)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"github.com/tarantool/go-tarantool"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ----- */
+
+// Push dispatcher, runs next to the harness commands with -dispatch. A poller
+// walks the devs change_ts index every poll interval and takes the devices
+// with pending changes, which are leased for -dispatch-lease. Sender goroutines
+// push them to a PushSender and report back with push_DevSent, which resets
+// change_count and change_priority or counts a send error.
+
+// Sends a push for the device's pending changes
+type PushSender interface {
+	send(dev *DevEnt) error
+}
+
+// Stands in for a push service which takes a fixed time per push
+type DelaySender struct {
+	delay time.Duration
+}
+
+func (s *DelaySender) send(dev *DevEnt) error {
+	if s.delay > 0 {
+		time.Sleep(s.delay)
+	}
+	return nil
+}
+
+type DispatcherReport struct {
+	Polls    int64 `json:"polls"`
+	Taken    int64 `json:"taken"`
+	Sent     int64 `json:"sent"`
+	Priority int64 `json:"priority"`
+	Failed   int64 `json:"failed"`
+	Errors   int64 `json:"errors"`
+}
+
+// Set in main when -dispatch is given
+var DISPATCHER *Dispatcher = nil
+
+type Dispatcher struct {
+	model    *PushDbModel
+	sender   PushSender
+	interval time.Duration
+	lease    Millitime
+	batch    int
+
+	report DispatcherReport
+
+	queue   chan DevEnt
+	senders sync.WaitGroup
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func startDispatcher(client *tarantool.Connection, sender PushSender,
+	interval time.Duration, lease time.Duration, batch int, conc int) *Dispatcher {
+
+	dp := &Dispatcher{model: NewPushDbModel(client), sender: sender, interval: interval,
+		lease: Millitime(lease / time.Millisecond), batch: batch,
+		queue: make(chan DevEnt, batch), done: make(chan struct{}), stopped: make(chan struct{})}
+
+	log.Printf("Dispatching pushes every %s, batch %d, %d senders, lease %s\n", interval, batch, conc, lease)
+
+	dp.senders.Add(conc)
+	for i := 0; i < conc; i++ {
+		go dp.runSender()
+	}
+	go dp.runPoller()
+
+	return dp
+}
+
+// Stops polling and waits for the devices already taken to be sent
+func (dp *Dispatcher) stop() {
+	if dp == nil {
+		return
+	}
+	close(dp.done)
+	<-dp.stopped
+	dp.senders.Wait()
+}
+
+func (dp *Dispatcher) runPoller() {
+	defer close(dp.stopped)
+	defer close(dp.queue)
+
+	ticker := time.NewTicker(dp.interval)
+	defer ticker.Stop()
+
+	// Devices with pending changes have change_ts at or after their last
+	// change, so each poll only needs to continue from where the last one ended
+	var cursor_ts Millitime
+	var cursor_skip int
+
+	for {
+		select {
+		case <-ticker.C:
+			cursor_ts, cursor_skip = dp.poll(cursor_ts, cursor_skip)
+		case <-dp.done:
+			return
+		}
+	}
+}
+
+func (dp *Dispatcher) poll(cursor_ts Millitime, cursor_skip int) (Millitime, int) {
+	atomic.AddInt64(&dp.report.Polls, 1)
+
+	now := milliTime()
+
+	for {
+		start := time.Now()
+		res, err := dp.model.doTakeDueDevs(cursor_ts, cursor_skip, now, dp.batch, dp.lease)
+		METRICS.observe(OP_TAKE_DUE, time.Since(start))
+		if err != nil {
+			log.Printf("Error taking due devices: %s\n", err)
+			atomic.AddInt64(&dp.report.Errors, 1)
+			return cursor_ts, cursor_skip
+		}
+
+		atomic.AddInt64(&dp.report.Taken, int64(len(res.devs)))
+		for _, dev := range res.devs {
+			select {
+			case dp.queue <- dev:
+			case <-dp.done:
+				// Not sent, the lease runs out and it's taken again
+				return res.next_ts, res.next_skip
+			}
+		}
+
+		cursor_ts = res.next_ts
+		cursor_skip = res.next_skip
+
+		if res.done {
+			return cursor_ts, cursor_skip
+		}
+	}
+}
+
+func (dp *Dispatcher) runSender() {
+	defer dp.senders.Done()
+
+	for dev := range dp.queue {
+		err := dp.sender.send(&dev)
+		if err != nil {
+			atomic.AddInt64(&dp.report.Failed, 1)
+		} else {
+			atomic.AddInt64(&dp.report.Sent, 1)
+			if dev.change_priority != 0 {
+				atomic.AddInt64(&dp.report.Priority, 1)
+			}
+		}
+
+		start := time.Now()
+		code, err := dp.model.doDevSent(dev.dev_id, dev.change_count, err == nil)
+		METRICS.observe(OP_DEV_SENT, time.Since(start))
+		if code != RES_OK || err != nil {
+			log.Printf("Error reporting a send: %s, %v\n", &code, err)
+			atomic.AddInt64(&dp.report.Errors, 1)
+		}
+	}
+}
+
+// Totals so far, nil when the dispatcher is off
+func (dp *Dispatcher) buildReport() *DispatcherReport {
+	if dp == nil {
+		return nil
+	}
+	return &DispatcherReport{
+		Polls:    atomic.LoadInt64(&dp.report.Polls),
+		Taken:    atomic.LoadInt64(&dp.report.Taken),
+		Sent:     atomic.LoadInt64(&dp.report.Sent),
+		Priority: atomic.LoadInt64(&dp.report.Priority),
+		Failed:   atomic.LoadInt64(&dp.report.Failed),
+		Errors:   atomic.LoadInt64(&dp.report.Errors)}
+}
+
+func (dp *Dispatcher) logReport() {
+	r := dp.buildReport()
+	if r == nil {
+		return
+	}
+	log.Printf("Dispatcher: %d polls, %d devices taken, %d pushes sent (%d priority), %d failed, %d errors\n",
+		r.Polls, r.Taken, r.Sent, r.Priority, r.Failed, r.Errors)
+}
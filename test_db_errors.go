@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tarantool/go-tarantool"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* ----- */
+
+// Failed calls are counted by class: the ResultCode name for codes returned by
+// the Lua procedures, or a connector failure kind for database errors
+
+const (
+	ERR_CLASS_TIMEOUT    = "timeout"
+	ERR_CLASS_CONNECTION = "connection"
+
+	// Percentage budgets are not checked before this many calls
+	ERR_BUDGET_MIN_CALLS = 100
+)
+
+func classifyError(code ResultCode, err error) string {
+	if dberr, ok := err.(*PushDbError); ok && dberr.cause != nil {
+		if cerr, ok := dberr.cause.(tarantool.ClientError); ok {
+			switch cerr.Code {
+			case tarantool.ErrTimeouted:
+				return ERR_CLASS_TIMEOUT
+			case tarantool.ErrConnectionNotReady, tarantool.ErrConnectionClosed:
+				return ERR_CLASS_CONNECTION
+			}
+		}
+	}
+	if code == RES_OK {
+		// No code but an error, e.g. a missing result
+		code = RES_ERR_DATABASE
+	}
+	return code.String()
+}
+
+// How many errors are tolerated: a count like "100", or a percentage of all
+// calls like "0.5%". The default of "0" stops at the first error.
+
+type ErrorBudget struct {
+	max int64
+	pct float64
+}
+
+func parseErrorBudget(s string) (*ErrorBudget, error) {
+	if strings.HasSuffix(s, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("Invalid error percentage %q", s)
+		}
+		return &ErrorBudget{pct: pct}, nil
+	}
+
+	max, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || max < 0 {
+		return nil, fmt.Errorf("Invalid error count %q", s)
+	}
+	return &ErrorBudget{max: max}, nil
+}
+
+func (b *ErrorBudget) exceeded(errors int64, calls int64) bool {
+	if b.pct > 0 {
+		return calls >= ERR_BUDGET_MIN_CALLS && float64(errors)*100 > float64(calls)*b.pct
+	}
+	return errors > b.max
+}
+
+func formatErrorCounts(errors map[string]int64) string {
+	classes := make([]string, 0, len(errors))
+	for class := range errors {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	parts := make([]string, len(classes))
+	for i, class := range classes {
+		parts[i] = fmt.Sprintf("%s %d", class, errors[class])
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/* ----- */
+
+// How ping and change workers pick subs out of the key pool:
+//
+//	uniform         - every sub equally likely
+//	zipf[:s]        - zipfian with skew s > 1, default 1.1
+//	hotspot[:x/y]   - x% of traffic goes to y% of subs, default 90/10
+//	seq             - walk the pool in order, shared by all workers
+
+const (
+	DIST_UNIFORM = "uniform"
+	DIST_ZIPF    = "zipf"
+	DIST_HOTSPOT = "hotspot"
+	DIST_SEQ     = "seq"
+
+	DIST_ZIPF_SKEW    = 1.1
+	DIST_HOT_TRAFFIC  = 90
+	DIST_HOT_KEYS_PCT = 10
+)
+
+type KeyDist struct {
+	kind string
+
+	skew float64
+
+	hot_traffic float64
+	hot_keys    float64
+
+	seq uint64
+}
+
+func parseKeyDist(s string) (*KeyDist, error) {
+	d := &KeyDist{kind: s}
+
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 2 {
+		d.kind = parts[0]
+	}
+
+	switch d.kind {
+	case DIST_UNIFORM, DIST_SEQ:
+		if len(parts) == 2 {
+			return nil, fmt.Errorf("Distribution %s takes no parameters", d.kind)
+		}
+	case DIST_ZIPF:
+		d.skew = DIST_ZIPF_SKEW
+		if len(parts) == 2 {
+			skew, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil || skew <= 1 {
+				return nil, fmt.Errorf("Invalid zipf skew %q, must be > 1", parts[1])
+			}
+			d.skew = skew
+		}
+	case DIST_HOTSPOT:
+		d.hot_traffic = DIST_HOT_TRAFFIC
+		d.hot_keys = DIST_HOT_KEYS_PCT
+		if len(parts) == 2 {
+			xy := strings.SplitN(parts[1], "/", 2)
+			if len(xy) != 2 {
+				return nil, fmt.Errorf("Invalid hotspot %q, expected traffic/keys percentages", parts[1])
+			}
+			traffic, err1 := strconv.ParseFloat(xy[0], 64)
+			keys, err2 := strconv.ParseFloat(xy[1], 64)
+			if err1 != nil || err2 != nil || traffic < 0 || traffic > 100 || keys <= 0 || keys > 100 {
+				return nil, fmt.Errorf("Invalid hotspot percentages %q", parts[1])
+			}
+			d.hot_traffic = traffic
+			d.hot_keys = keys
+		}
+	default:
+		return nil, fmt.Errorf("Unknown key distribution %q", d.kind)
+	}
+
+	return d, nil
+}
+
+func (d *KeyDist) String() string {
+	switch d.kind {
+	case DIST_ZIPF:
+		return fmt.Sprintf("%s:%g", d.kind, d.skew)
+	case DIST_HOTSPOT:
+		return fmt.Sprintf("%s:%g/%g", d.kind, d.hot_traffic, d.hot_keys)
+	default:
+		return d.kind
+	}
+}
+
+/* ----- */
+
+// Per worker state, rand.Zipf is not safe for concurrent use
+
+type KeyChooser struct {
+	dist *KeyDist
+
+	rnd    *rand.Rand
+	zipf   *rand.Zipf
+	zipf_n int
+}
+
+func (d *KeyDist) newChooser(rnd *rand.Rand) *KeyChooser {
+	return &KeyChooser{dist: d, rnd: rnd}
+}
+
+// Returns an index in [0, n)
+func (c *KeyChooser) next(n int) int {
+	d := c.dist
+
+	switch d.kind {
+	case DIST_ZIPF:
+		if c.zipf == nil || c.zipf_n != n {
+			c.zipf = rand.NewZipf(c.rnd, d.skew, 1, uint64(n-1))
+			c.zipf_n = n
+		}
+		return int(c.zipf.Uint64())
+	case DIST_HOTSPOT:
+		hot_n := int(float64(n) * d.hot_keys / 100)
+		if hot_n < 1 {
+			hot_n = 1
+		}
+		if hot_n >= n || c.rnd.Float64()*100 < d.hot_traffic {
+			return c.rnd.Intn(hot_n)
+		}
+		return hot_n + c.rnd.Intn(n-hot_n)
+	case DIST_SEQ:
+		return int((atomic.AddUint64(&d.seq, 1) - 1) % uint64(n))
+	default:
+		return c.rnd.Intn(n)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/tarantool/go-tarantool"
+	"io"
+	"log"
+	"os"
+)
+
+/* ----- */
+
+// Key pool file: gzip of a magic header, the entry count, and then dev_id,
+// folder_id and sub_id of each entry as length prefixed strings
+
+const (
+	KEYS_FILE_MAGIC = "PUSHKEYS1"
+
+	// Limits for reading, so that a damaged file is an error and not a panic
+	KEYS_FILE_MAX_KEY_LEN  = 4096
+	KEYS_FILE_MAX_PREALLOC = 1 << 20
+)
+
+// Loads the pool from the database first if no command has filled it yet
+func saveListEnts(path string, client *tarantool.Connection) {
+	loadDevicesAndSubs(client, 0)
+
+	LIST_MUTEX.RLock()
+	defer LIST_MUTEX.RUnlock()
+
+	if err := writeKeysFile(path, LIST_ENTS); err != nil {
+		log.Fatalf("Error saving keys to %s: %s", path, err)
+	}
+
+	log.Printf("Saved %d ents to %s\n", len(LIST_ENTS), path)
+}
+
+func loadListEnts(path string) {
+	list_ents, err := readKeysFile(path)
+	if err != nil {
+		log.Fatalf("Error loading keys from %s: %s", path, err)
+	}
+
+	LIST_MUTEX.Lock()
+	defer LIST_MUTEX.Unlock()
+
+	LIST_ENTS = list_ents
+
+	log.Printf("Loaded %d ents from %s\n", len(LIST_ENTS), path)
+}
+
+func writeKeysFile(path string, list_ents []DevFolderSub) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(f)
+	w := bufio.NewWriter(gz)
+
+	var buf [binary.MaxVarintLen64]byte
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf[:], v)
+		w.Write(buf[:n])
+	}
+	writeString := func(s string) {
+		writeUvarint(uint64(len(s)))
+		w.WriteString(s)
+	}
+
+	w.WriteString(KEYS_FILE_MAGIC)
+	writeUvarint(uint64(len(list_ents)))
+	for _, ent := range list_ents {
+		writeString(ent.dev_id)
+		writeString(ent.folder_id)
+		writeString(ent.sub_id)
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readKeysFile(path string) ([]DevFolderSub, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(gz)
+
+	magic := make([]byte, len(KEYS_FILE_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != KEYS_FILE_MAGIC {
+		return nil, errors.New("Not a keys file")
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	readString := func() (string, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return "", err
+		}
+		if l > KEYS_FILE_MAX_KEY_LEN {
+			return "", fmt.Errorf("Key length %d is over %d", l, KEYS_FILE_MAX_KEY_LEN)
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	// The count is not trusted until the entries are read
+	prealloc := count
+	if prealloc > KEYS_FILE_MAX_PREALLOC {
+		prealloc = KEYS_FILE_MAX_PREALLOC
+	}
+
+	list_ents := make([]DevFolderSub, 0, prealloc)
+	for i := uint64(0); i < count; i++ {
+		var ent DevFolderSub
+		if ent.dev_id, err = readString(); err != nil {
+			return nil, fmt.Errorf("Entry %d: %s", i, err)
+		}
+		if ent.folder_id, err = readString(); err != nil {
+			return nil, fmt.Errorf("Entry %d: %s", i, err)
+		}
+		if ent.sub_id, err = readString(); err != nil {
+			return nil, fmt.Errorf("Entry %d: %s", i, err)
+		}
+		list_ents = append(list_ents, ent)
+	}
+
+	return list_ents, nil
+}
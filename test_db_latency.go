@@ -0,0 +1,219 @@
+package main
+
+import (
+	"log"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+/* ----- */
+
+// Model operations timed by the harness
+type OpKind int
+
+const (
+	OP_CREATE_DEV OpKind = iota
+	OP_CREATE_SUB
+	OP_PING_SUB
+	OP_CHANGE_SUB
+	OP_LIST_SUBS
+	OP_DELETE_SUB
+	OP_DELETE_DEV
+	OP_TAKE_DUE
+	OP_DEV_SENT
+
+	OP_COUNT
+)
+
+var OP_NAMES = [OP_COUNT]string{
+	OP_CREATE_DEV: "createDev",
+	OP_CREATE_SUB: "createSub",
+	OP_PING_SUB:   "pingSub",
+	OP_CHANGE_SUB: "changeSub",
+	OP_LIST_SUBS:  "listSubs",
+	OP_DELETE_SUB: "deleteSub",
+	OP_DELETE_DEV: "deleteDev",
+	OP_TAKE_DUE:   "takeDueDevs",
+	OP_DEV_SENT:   "devSent",
+}
+
+func (op OpKind) String() string {
+	return OP_NAMES[op]
+}
+
+/* ----- */
+
+// HDR-style histogram: values are in microseconds, each power of two is split
+// into HIST_SUB_COUNT linear buckets, so relative error is under 2%
+
+const (
+	HIST_SUB_BITS   = 6
+	HIST_SUB_COUNT  = 1 << HIST_SUB_BITS
+	HIST_MAX_MICROS = int64(10 * time.Minute / time.Microsecond)
+)
+
+var HIST_BUCKET_COUNT = histBucketIndex(HIST_MAX_MICROS) + 1
+
+type Histogram struct {
+	counts []int64
+	count  int64
+	max    int64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]int64, HIST_BUCKET_COUNT)}
+}
+
+func histBucketIndex(v int64) int {
+	if v < HIST_SUB_COUNT {
+		return int(v)
+	}
+	shift := uint(bits.Len64(uint64(v)) - HIST_SUB_BITS - 1)
+	return int(shift+1)*HIST_SUB_COUNT + int(v>>shift) - HIST_SUB_COUNT
+}
+
+func histBucketValue(index int) int64 {
+	if index < HIST_SUB_COUNT {
+		return int64(index)
+	}
+	shift := uint(index/HIST_SUB_COUNT - 1)
+	sub := int64(index%HIST_SUB_COUNT + HIST_SUB_COUNT)
+	// Upper bound of the bucket
+	return ((sub + 1) << shift) - 1
+}
+
+func (h *Histogram) record(d time.Duration) {
+	v := int64(d / time.Microsecond)
+	if v < 0 {
+		v = 0
+	} else if v > HIST_MAX_MICROS {
+		v = HIST_MAX_MICROS
+	}
+	h.counts[histBucketIndex(v)]++
+	h.count++
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *Histogram) merge(other *Histogram) {
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.count += other.count
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+func (h *Histogram) percentile(pct float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	want := int64(float64(h.count)*pct/100.0 + 0.5)
+	if want < 1 {
+		want = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= want {
+			v := histBucketValue(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return h.maxDuration()
+}
+
+func (h *Histogram) maxDuration() time.Duration {
+	return time.Duration(h.max) * time.Microsecond
+}
+
+/* ----- */
+
+// Per-operation latencies, both for the whole command and since the last progress tick
+
+type OpLatency struct {
+	mutex    sync.Mutex
+	total    *Histogram
+	interval *Histogram
+}
+
+type LatencyStats struct {
+	ops [OP_COUNT]OpLatency
+}
+
+func NewLatencyStats() *LatencyStats {
+	s := &LatencyStats{}
+	for i := range s.ops {
+		s.ops[i].total = NewHistogram()
+		s.ops[i].interval = NewHistogram()
+	}
+	return s
+}
+
+func (s *LatencyStats) record(op OpKind, d time.Duration) {
+	l := &s.ops[op]
+	l.mutex.Lock()
+	l.total.record(d)
+	l.interval.record(d)
+	l.mutex.Unlock()
+}
+
+func (s *LatencyStats) takeInterval() [OP_COUNT]*Histogram {
+	var res [OP_COUNT]*Histogram
+	for i := range s.ops {
+		l := &s.ops[i]
+		l.mutex.Lock()
+		res[i] = l.interval
+		l.interval = NewHistogram()
+		l.mutex.Unlock()
+	}
+	return res
+}
+
+// Drops everything recorded so far
+func (s *LatencyStats) reset() {
+	for i := range s.ops {
+		l := &s.ops[i]
+		l.mutex.Lock()
+		l.total = NewHistogram()
+		l.interval = NewHistogram()
+		l.mutex.Unlock()
+	}
+}
+
+func (s *LatencyStats) takeTotal() [OP_COUNT]*Histogram {
+	var res [OP_COUNT]*Histogram
+	for i := range s.ops {
+		l := &s.ops[i]
+		l.mutex.Lock()
+		res[i] = NewHistogram()
+		res[i].merge(l.total)
+		l.mutex.Unlock()
+	}
+	return res
+}
+
+func logLatencies(hists [OP_COUNT]*Histogram, elapsed time.Duration) {
+	for op, h := range hists {
+		if h.count == 0 {
+			continue
+		}
+		log.Printf("    %-10s n = %7d, %9.2f rps, p50 = %8.3f, p90 = %8.3f, p99 = %8.3f, p99.9 = %8.3f, max = %8.3f ms\n",
+			OpKind(op), h.count, float64(h.count)/elapsed.Seconds(),
+			durationMillis(h.percentile(50)),
+			durationMillis(h.percentile(90)),
+			durationMillis(h.percentile(99)),
+			durationMillis(h.percentile(99.9)),
+			durationMillis(h.maxDuration()))
+	}
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ----- */
+
+// Prometheus text format endpoint, served with -metrics while the harness runs.
+// Everything here is cumulative over the whole process, across commands.
+
+var METRICS_BUCKETS = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Atomic counters, workers record calls into them without taking a lock
+type MetricsOp struct {
+	count   int64
+	sum_ns  int64
+	buckets []int64
+}
+
+func (o *MetricsOp) add(d time.Duration) {
+	v := d.Seconds()
+	for i, le := range METRICS_BUCKETS {
+		if v <= le {
+			atomic.AddInt64(&o.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&o.sum_ns, int64(d))
+	atomic.AddInt64(&o.count, 1)
+}
+
+type Metrics struct {
+	in_flight int64
+	ops       [OP_COUNT]MetricsOp
+	sweep     MetricsOp
+
+	mutex    sync.Mutex
+	command  string
+	requests int64
+	rps      float64
+	errors   map[string]int64
+
+	sweep_passes  int64
+	sweep_swept   int64
+	sweep_scanned int64
+}
+
+// Set in main when -metrics is given
+var METRICS *Metrics = nil
+
+func NewMetrics() *Metrics {
+	m := &Metrics{errors: make(map[string]int64)}
+	for i := range m.ops {
+		m.ops[i].buckets = make([]int64, len(METRICS_BUCKETS))
+	}
+	m.sweep.buckets = make([]int64, len(METRICS_BUCKETS))
+	return m
+}
+
+func startMetrics(addr string) *Metrics {
+	m := NewMetrics()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	go func() {
+		log.Printf("Serving metrics on %s/metrics\n", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("Error serving metrics: %s", err)
+		}
+	}()
+
+	return m
+}
+
+func (m *Metrics) setCommand(command string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.command = command
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) addInFlight(delta int64) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.in_flight, delta)
+}
+
+func (m *Metrics) observe(op OpKind, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.ops[op].add(d)
+}
+
+// One batch of the stale sub sweeper
+func (m *Metrics) observeSweep(d time.Duration, swept int, scanned int) {
+	if m == nil {
+		return
+	}
+	m.sweep.add(d)
+
+	m.mutex.Lock()
+	m.sweep_swept += int64(swept)
+	m.sweep_scanned += int64(scanned)
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) addSweepPass() {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.sweep_passes++
+	m.mutex.Unlock()
+}
+
+func (m *Metrics) addError(code string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.errors[code]++
+	m.mutex.Unlock()
+}
+
+// Called by the progress sampler with the delta since the last sample
+func (m *Metrics) sample(requests int64, rps float64) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	m.requests += requests
+	m.rps = rps
+	m.mutex.Unlock()
+}
+
+// Renders into a buffer and writes it after unlocking, so that a slow scrape
+// doesn't hold up the workers
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.render(&buf)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func (m *Metrics) render(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP pushdb_command Command being run by the harness\n")
+	fmt.Fprintf(w, "# TYPE pushdb_command gauge\n")
+	if m.command != "" {
+		fmt.Fprintf(w, "pushdb_command{command=%q} 1\n", m.command)
+	}
+
+	fmt.Fprintf(w, "# HELP pushdb_requests_total Requests completed by harness workers\n")
+	fmt.Fprintf(w, "# TYPE pushdb_requests_total counter\n")
+	fmt.Fprintf(w, "pushdb_requests_total %d\n", m.requests)
+
+	fmt.Fprintf(w, "# HELP pushdb_requests_rps Requests per second in the last sample interval\n")
+	fmt.Fprintf(w, "# TYPE pushdb_requests_rps gauge\n")
+	fmt.Fprintf(w, "pushdb_requests_rps %.2f\n", m.rps)
+
+	fmt.Fprintf(w, "# HELP pushdb_in_flight Model calls in flight\n")
+	fmt.Fprintf(w, "# TYPE pushdb_in_flight gauge\n")
+	fmt.Fprintf(w, "pushdb_in_flight %d\n", atomic.LoadInt64(&m.in_flight))
+
+	fmt.Fprintf(w, "# HELP pushdb_op_duration_seconds Model call latency\n")
+	fmt.Fprintf(w, "# TYPE pushdb_op_duration_seconds histogram\n")
+	for i := range m.ops {
+		writeHistogram(w, "pushdb_op_duration_seconds", fmt.Sprintf("op=%q,", OpKind(i).String()), &m.ops[i])
+	}
+
+	fmt.Fprintf(w, "# HELP pushdb_errors_total Failed model calls by result code\n")
+	fmt.Fprintf(w, "# TYPE pushdb_errors_total counter\n")
+	codes := make([]string, 0, len(m.errors))
+	for code := range m.errors {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "pushdb_errors_total{code=%q} %d\n", code, m.errors[code])
+	}
+
+	fmt.Fprintf(w, "# HELP pushdb_sweep_batch_duration_seconds Stale sub sweeper batch duration\n")
+	fmt.Fprintf(w, "# TYPE pushdb_sweep_batch_duration_seconds histogram\n")
+	writeHistogram(w, "pushdb_sweep_batch_duration_seconds", "", &m.sweep)
+
+	fmt.Fprintf(w, "# HELP pushdb_sweep_passes_total Stale sub sweeper passes over the ping_ts index\n")
+	fmt.Fprintf(w, "# TYPE pushdb_sweep_passes_total counter\n")
+	fmt.Fprintf(w, "pushdb_sweep_passes_total %d\n", m.sweep_passes)
+
+	fmt.Fprintf(w, "# HELP pushdb_sweep_swept_total Subs marked dead by the sweeper\n")
+	fmt.Fprintf(w, "# TYPE pushdb_sweep_swept_total counter\n")
+	fmt.Fprintf(w, "pushdb_sweep_swept_total %d\n", m.sweep_swept)
+
+	fmt.Fprintf(w, "# HELP pushdb_sweep_scanned_total Subs scanned by the sweeper\n")
+	fmt.Fprintf(w, "# TYPE pushdb_sweep_scanned_total counter\n")
+	fmt.Fprintf(w, "pushdb_sweep_scanned_total %d\n", m.sweep_scanned)
+}
+
+// Labels are empty or end with a comma
+func writeHistogram(w io.Writer, name string, labels string, o *MetricsOp) {
+	var cumulative int64
+	for j, le := range METRICS_BUCKETS {
+		cumulative += atomic.LoadInt64(&o.buckets[j])
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, le, cumulative)
+	}
+
+	// Calls can be recorded while this runs, keep the count at least the buckets total
+	count := atomic.LoadInt64(&o.count)
+	if count < cumulative {
+		count = cumulative
+	}
+	sum := time.Duration(atomic.LoadInt64(&o.sum_ns)).Seconds()
+
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, count)
+	if labels == "" {
+		fmt.Fprintf(w, "%s_sum %g\n", name, sum)
+		fmt.Fprintf(w, "%s_count %d\n", name, count)
+		return
+	}
+	labels = labels[:len(labels)-1]
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, count)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tarantool/go-tarantool"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+/* ----- */
+
+const (
+	MIX_SUBS   = "subs"
+	MIX_PING   = "ping"
+	MIX_CHANGE = "change"
+
+	MIX_DEFAULT = "ping=70,change=25,subs=5"
+)
+
+// Weighted mix of operations, e.g. "ping=70,change=25,subs=5"
+
+type MixWeights struct {
+	names   []string
+	weights []int
+	total   int
+}
+
+func parseMixWeights(s string) (*MixWeights, error) {
+	return parseWeights(s, []string{MIX_SUBS, MIX_PING, MIX_CHANGE})
+}
+
+// Weights for any of the given names
+func parseWeights(s string, names []string) (*MixWeights, error) {
+	m := &MixWeights{}
+
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid mix entry %q, expected name=weight", part)
+		}
+
+		name := kv[0]
+		known := false
+		for _, n := range names {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown mix operation %q", name)
+		}
+		for _, n := range m.names {
+			if n == name {
+				return nil, fmt.Errorf("Mix operation %s is given more than once", name)
+			}
+		}
+
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid mix weight %q for %s", kv[1], name)
+		}
+
+		m.names = append(m.names, name)
+		m.weights = append(m.weights, weight)
+		m.total += weight
+	}
+
+	if m.total == 0 {
+		return nil, fmt.Errorf("Mix weights add up to zero")
+	}
+
+	return m, nil
+}
+
+func (m *MixWeights) pick(rnd *rand.Rand) string {
+	r := rnd.Intn(m.total)
+	for i, w := range m.weights {
+		if r < w {
+			return m.names[i]
+		}
+		r -= w
+	}
+	return m.names[len(m.names)-1]
+}
+
+func (m *MixWeights) String() string {
+	parts := make([]string, len(m.names))
+	for i, name := range m.names {
+		parts[i] = fmt.Sprintf("%s=%d", name, m.weights[i])
+	}
+	return strings.Join(parts, ",")
+}
+
+/* ----- */
+
+// Key pool shared by concurrent workers which also add to it
+
+func pickListEnt(chooser *KeyChooser) (DevFolderSub, bool) {
+	LIST_MUTEX.RLock()
+	defer LIST_MUTEX.RUnlock()
+
+	size_ents := len(LIST_ENTS)
+	if size_ents == 0 {
+		return DevFolderSub{}, false
+	}
+	return LIST_ENTS[chooser.next(size_ents)], true
+}
+
+func addListEnt(ent DevFolderSub) {
+	LIST_MUTEX.Lock()
+	defer LIST_MUTEX.Unlock()
+
+	LIST_ENTS = append(LIST_ENTS, ent)
+}
+
+/* ----- */
+
+func newRunFuncMix(mix *MixWeights) WorkerFunc {
+	return func(client *tarantool.Connection, keylen int, numreq int, p *Worker) {
+		runFuncMix(mix, client, keylen, numreq, p)
+	}
+}
+
+func runFuncMix(mix *MixWeights, client *tarantool.Connection, keylen int, numreq int, p *Worker) {
+	loadDevicesAndSubs(client, numreq)
+
+	model := NewPushDbModel(client)
+	chooser := p.dist.newChooser(p.rnd)
+
+	for i := 0; p.more(i, numreq); i++ {
+		name := mix.pick(p.rnd)
+
+		var ent DevFolderSub
+		if name != MIX_SUBS {
+			var ok bool
+			if ent, ok = pickListEnt(chooser); !ok {
+				// Nothing to ping or change yet
+				name = MIX_SUBS
+			}
+		}
+
+		ok := false
+		switch name {
+		case MIX_SUBS:
+			ok = mixCreateDevSub(model, keylen, i, p)
+		case MIX_PING:
+			ok = mixPingSub(model, ent, p)
+		case MIX_CHANGE:
+			ok = mixChangeSub(model, ent, p)
+		}
+
+		if ok {
+			p.increment()
+		}
+	}
+}
+
+// Each returns false if the call failed
+
+func mixCreateDevSub(model *PushDbModel, keylen int, i int, p *Worker) bool {
+	dev_id := genRandomString(p.rnd, keylen)
+	auth := genRandomString(p.rnd, AUTH_STRING_LEN)
+	push_token := genPushToken(p.rnd)
+	now := milliTime()
+
+	// Model
+	start := p.begin()
+	t_dev, code, err := model.doCreateDev(dev_id, auth, push_token, PUSH_TECH_GCM_DEBUG, now)
+	p.observe(OP_CREATE_DEV, start)
+	if t_dev == nil || code != RES_OK || err != nil {
+		p.failed(code, err)
+		return false
+	}
+
+	// Model
+	folder_id := fmt.Sprintf("%08d", i)
+	sub_id := genRandomString(p.rnd, keylen)
+	start = p.begin()
+	code, err = model.doCreateSub(dev_id, folder_id, sub_id, now)
+	p.observe(OP_CREATE_SUB, start)
+	if code != RES_OK || err != nil {
+		p.failed(code, err)
+		return false
+	}
+
+	addListEnt(NewDevFolderSub_Vars(dev_id, folder_id, sub_id))
+	return true
+}
+
+func mixPingSub(model *PushDbModel, ent DevFolderSub, p *Worker) bool {
+	ping_ts := milliTime()
+
+	// Model
+	start := p.begin()
+	code, err := model.doPingSub(ent.dev_id, ent.folder_id, ent.sub_id, ping_ts)
+	p.observe(OP_PING_SUB, start)
+	if code != RES_OK || err != nil {
+		p.failed(code, err)
+		return false
+	}
+	return true
+}
+
+func mixChangeSub(model *PushDbModel, ent DevFolderSub, p *Worker) bool {
+	change_ts := milliTime()
+	delta := TIME_MS_500_MILLIS
+
+	// Model
+	start := p.begin()
+	code, err := model.doChangeSub(ent.dev_id, ent.folder_id, ent.sub_id, change_ts, delta, false)
+	p.observe(OP_CHANGE_SUB, start)
+	if code != RES_OK || err != nil {
+		p.failed(code, err)
+		return false
+	}
+	return true
+}
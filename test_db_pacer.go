@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ----- */
+
+// Open loop pacing: every model call gets a slot on a fixed arrival timeline,
+// no matter how long earlier calls took. Latency is measured from the slot
+// time, so server stalls are not hidden by workers waiting on each other.
+// The timeline starts with the first call, once workers have loaded their keys.
+
+type Pacer struct {
+	rate  int
+	start sync.Once
+	since time.Time
+
+	next    int64
+	late    int64
+	max_lag int64
+}
+
+func NewPacer(rate int) *Pacer {
+	return &Pacer{rate: rate}
+}
+
+func (pc *Pacer) slotTime(n int64) time.Time {
+	return pc.since.Add(time.Duration(n * int64(time.Second) / int64(pc.rate)))
+}
+
+// Waits for the next slot and returns its intended send time
+func (pc *Pacer) wait() time.Time {
+	pc.start.Do(func() {
+		pc.since = time.Now()
+	})
+
+	n := atomic.AddInt64(&pc.next, 1) - 1
+	intended := pc.slotTime(n)
+
+	delay := time.Until(intended)
+	if delay > 0 {
+		time.Sleep(delay)
+	} else {
+		lag := int64(-delay)
+		atomic.AddInt64(&pc.late, 1)
+		for {
+			max_lag := atomic.LoadInt64(&pc.max_lag)
+			if lag <= max_lag || atomic.CompareAndSwapInt64(&pc.max_lag, max_lag, lag) {
+				break
+			}
+		}
+	}
+
+	return intended
+}
+
+func (pc *Pacer) logReport() {
+	now := time.Now()
+	sent := atomic.LoadInt64(&pc.next)
+	if sent == 0 {
+		log.Printf("Target rate: %d calls/s, no calls were made\n", pc.rate)
+		return
+	}
+	elapsed := now.Sub(pc.since).Seconds()
+
+	log.Printf("Target rate: %d calls/s, achieved: %.2f calls/s\n", pc.rate, float64(sent)/elapsed)
+	log.Printf("Late calls: %d of %d, max lag: %s\n", atomic.LoadInt64(&pc.late), sent,
+		time.Duration(atomic.LoadInt64(&pc.max_lag)))
+
+	behind := now.Sub(pc.slotTime(sent))
+	if behind > 0 {
+		log.Printf("Finished %s after the scheduled end\n", behind)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/* ----- */
+
+// Keeps up to depth asynchronous calls in flight for one worker. Each call is
+// waited for by its own goroutine, so that its latency is taken when its
+// response arrives and not when the worker gets around to it.
+
+// Commands whose workers pipeline their calls with -pipeline
+var PIPELINE_COMMANDS = []string{"ping", "change", "list"}
+
+type Pipeline struct {
+	p     *Worker
+	slots chan struct{}
+	calls sync.WaitGroup
+}
+
+// Returns nil when pipelining is off
+func NewPipeline(p *Worker, depth int) *Pipeline {
+	if depth <= 1 {
+		return nil
+	}
+	return &Pipeline{p: p, slots: make(chan struct{}, depth)}
+}
+
+// Waits until there is room for one more call
+func (pl *Pipeline) reserve() {
+	pl.slots <- struct{}{}
+}
+
+func (pl *Pipeline) add(op OpKind, start time.Time, future *PushDbFuture) {
+	pl.calls.Add(1)
+	go pl.complete(op, start, future)
+}
+
+func (pl *Pipeline) drain() {
+	if pl == nil {
+		return
+	}
+	pl.calls.Wait()
+}
+
+func (pl *Pipeline) complete(op OpKind, start time.Time, future *PushDbFuture) {
+	defer func() {
+		<-pl.slots
+		pl.calls.Done()
+	}()
+
+	var code ResultCode
+	var err error
+	if op == OP_LIST_SUBS {
+		_, code, err = future.getSubList()
+	} else {
+		code, err = future.getResultCode()
+	}
+	pl.p.observe(op, start)
+	if code != RES_OK || err != nil {
+		pl.p.failed(code, err)
+		return
+	}
+
+	pl.p.increment()
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ----- */
+
+// Counts completed requests and samples them into a time series. Every worker
+// has its own counter on its own cache line, and a single sampler goroutine
+// reads them all on a fixed interval, so workers never contend on a shared
+// counter and each interval's rps comes from one consistent reader. Samples
+// all go to the report, the console gets one line per -log-interval.
+
+const (
+	CACHE_LINE_SIZE = 64
+)
+
+type WorkerCounter struct {
+	count int64
+	conn  int64
+	_     [CACHE_LINE_SIZE - 16]byte
+}
+
+type Progress struct {
+	name  string
+	since time.Time
+	conc  int
+
+	counters []WorkerCounter
+	conns    int
+
+	latency  *LatencyStats
+	pacer    *Pacer
+	deadline time.Time
+	dist     *KeyDist
+	pipeline int
+	cliffs   *CliffDetector
+	server   *ServerStatsCollector
+
+	// Owned by the sampler goroutine
+	last_since time.Time
+	last_count int64
+
+	// Console output, samples since the last line printed
+	log_interval time.Duration
+	log_since    time.Time
+	log_count    int64
+	log_hists    [OP_COUNT]*Histogram
+	log_errors   map[string]int64
+	log_server   *ServerStats
+
+	sampler_done    chan struct{}
+	sampler_stopped chan struct{}
+
+	budget *ErrorBudget
+
+	// Over the error budget, one worker saves the results and exits
+	exit_once sync.Once
+
+	// Warm-up, samples are discarded until it ends after a duration or a count
+	warming      int32
+	warmup_dur   time.Duration
+	warmup_count int64
+	warmup_left  int64
+	warmup_once  sync.Once
+	warmup_done  chan struct{}
+	warmup_timer *time.Timer
+
+	mutex           sync.Mutex
+	warmup          *WarmupReport
+	base_count      int64
+	intervals       []IntervalReport
+	errors          map[string]int64
+	error_count     int64
+	interval_errors map[string]int64
+}
+
+func NewProgress(name string, flags Flags, conns int) *Progress {
+	p := &Progress{name: name, since: time.Now(), conc: flags.conc,
+		counters: make([]WorkerCounter, flags.conc), conns: conns,
+		latency: NewLatencyStats(), errors: make(map[string]int64), interval_errors: make(map[string]int64)}
+	p.pipeline = flags.pipeline
+	p.log_interval = flags.log_interval
+	// Already validated in main
+	p.dist, _ = parseKeyDist(flags.dist)
+	p.budget, _ = parseErrorBudget(flags.max_errors)
+	p.warmup_dur, p.warmup_count, _ = parseWarmup(flags.warmup)
+	if p.warmup_dur > 0 || p.warmup_count > 0 {
+		p.warming = 1
+		p.warmup_left = p.warmup_count
+		p.warmup_done = make(chan struct{})
+	}
+	if flags.rate > 0 {
+		p.pacer = NewPacer(flags.rate)
+	}
+	if flags.duration > 0 {
+		// A warm-up duration comes on top of the measured one
+		p.deadline = time.Now().Add(p.warmup_dur + flags.duration)
+	}
+	if flags.cliff_pct > 0 {
+		p.cliffs = NewCliffDetector(flags.cliff_pct, flags.cliff_dur)
+	}
+	return p
+}
+
+// Duration mode: workers run until the deadline instead of a request count
+func (p *Progress) timed() bool {
+	return !p.deadline.IsZero()
+}
+
+func (p *Progress) expired() bool {
+	return p.timed() && !time.Now().Before(p.deadline)
+}
+
+// Whether a worker should make its request number i out of numreq
+func (p *Progress) more(i int, numreq int) bool {
+	if p.timed() {
+		return !p.expired()
+	}
+	return i < numreq
+}
+
+// Returns the time the next call should be measured from
+func (p *Progress) begin() time.Time {
+	start := time.Now()
+	if p.pacer != nil {
+		start = p.pacer.wait()
+	}
+	METRICS.addInFlight(1)
+	return start
+}
+
+func (p *Progress) observe(op OpKind, start time.Time) {
+	d := time.Since(start)
+	if !p.warmingUp() {
+		p.latency.record(op, d)
+	}
+	METRICS.addInFlight(-1)
+	METRICS.observe(op, d)
+}
+
+func (p *Progress) completed() int64 {
+	var count int64
+	for i := range p.counters {
+		count += atomic.LoadInt64(&p.counters[i].count)
+	}
+	return count
+}
+
+/* ----- */
+
+// Warm-up is either a duration like 5s or a request count, empty for none
+func parseWarmup(s string) (time.Duration, int64, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	// A zero duration, like 0 or 0s, is no warm-up
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return 0, 0, errors.New("Warm-up duration must not be negative")
+		}
+		return d, 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 {
+		return 0, 0, errors.New("Expected a duration or a request count")
+	}
+	return 0, n, nil
+}
+
+func (p *Progress) warmingUp() bool {
+	return atomic.LoadInt32(&p.warming) != 0
+}
+
+// Called when the warm-up count or duration is reached, the sampler does the rest
+func (p *Progress) endWarmup() {
+	p.warmup_once.Do(func() {
+		close(p.warmup_done)
+	})
+}
+
+// Takes the last warm-up sample and starts the measured window, warm-up
+// latencies and errors are not counted in it
+func (p *Progress) finishWarmup(now time.Time) {
+	p.sample(now)
+	p.logSamples(now)
+	p.latency.reset()
+
+	p.mutex.Lock()
+	elapsed := now.Sub(p.since)
+	p.warmup = &WarmupReport{
+		Elapsed:   elapsed.Seconds(),
+		Requests:  p.last_count,
+		Rps:       float64(p.last_count) / elapsed.Seconds(),
+		Errors:    p.errors,
+		Intervals: p.intervals}
+	p.intervals = nil
+	p.errors = make(map[string]int64)
+	p.error_count = 0
+	p.since = now
+	p.base_count = p.last_count
+	p.mutex.Unlock()
+
+	atomic.StoreInt32(&p.warming, 0)
+
+	log.Printf("Warm-up done: %s, %d requests\n", elapsed, p.last_count)
+	if len(p.warmup.Errors) != 0 {
+		log.Printf("    warm-up errors %s\n", formatErrorCounts(p.warmup.Errors))
+	}
+}
+
+// Start time and request count of the measured window
+func (p *Progress) measured() (time.Time, int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.since, p.completed() - p.base_count
+}
+
+/* ----- */
+
+func (p *Progress) startSampler(interval time.Duration) {
+	p.last_since = time.Now()
+	p.last_count = 0
+	p.resetLog(p.last_since)
+	p.sampler_done = make(chan struct{})
+	p.sampler_stopped = make(chan struct{})
+	if p.warmup_dur > 0 {
+		p.warmup_timer = time.AfterFunc(p.warmup_dur, p.endWarmup)
+	}
+
+	go p.runSampler(interval)
+}
+
+// Stops the sampler after it takes the last, partial, sample
+func (p *Progress) stopSampler() {
+	if p.warmup_timer != nil {
+		p.warmup_timer.Stop()
+	}
+	close(p.sampler_done)
+	<-p.sampler_stopped
+}
+
+func (p *Progress) runSampler(interval time.Duration) {
+	defer close(p.sampler_stopped)
+
+	ticker := time.NewTicker(interval)
+	defer func() {
+		ticker.Stop()
+	}()
+
+	// Nil when there is no warm-up, or once it's over
+	warmup_done := p.warmup_done
+
+	for {
+		select {
+		case <-warmup_done:
+			warmup_done = nil
+			p.finishWarmup(time.Now())
+			// Measured intervals are aligned to the end of warm-up
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
+		case now := <-ticker.C:
+			p.sample(now)
+		case <-p.sampler_done:
+			now := time.Now()
+			if p.completed() > p.last_count {
+				p.sample(now)
+			}
+			if p.log_count < p.last_count || len(p.log_errors) != 0 {
+				p.logSamples(now)
+			}
+			return
+		}
+	}
+}
+
+func (p *Progress) sample(now time.Time) {
+	new_count := p.completed()
+	elapsed := now.Sub(p.last_since)
+	rps := float64(new_count-p.last_count) / elapsed.Seconds()
+	last_since := p.last_since
+	last_count := p.last_count
+	p.last_since = now
+	p.last_count = new_count
+	warming := p.warmingUp()
+	METRICS.sample(new_count-last_count, rps)
+
+	hists := p.latency.takeInterval()
+	server := p.server.take()
+
+	p.mutex.Lock()
+	errors := p.interval_errors
+	p.interval_errors = make(map[string]int64)
+	if !warming {
+		p.cliffs.add(last_since, last_count, now, new_count, rps)
+	}
+	p.intervals = append(p.intervals, IntervalReport{
+		Time:     now,
+		Elapsed:  now.Sub(p.since).Seconds(),
+		Requests: new_count - p.base_count,
+		Rps:      rps,
+		Ops:      newOpReports(hists, elapsed),
+		Errors:   errors,
+		Server:   server})
+	p.mutex.Unlock()
+
+	for i, h := range hists {
+		p.log_hists[i].merge(h)
+	}
+	for class, n := range errors {
+		p.log_errors[class] += n
+	}
+	if server != nil {
+		p.log_server = server
+	}
+	if now.Sub(p.log_since) >= p.log_interval {
+		p.logSamples(now)
+	}
+}
+
+func (p *Progress) resetLog(now time.Time) {
+	p.log_since = now
+	p.log_count = p.last_count
+	for i := range p.log_hists {
+		p.log_hists[i] = NewHistogram()
+	}
+	p.log_errors = make(map[string]int64)
+	p.log_server = nil
+}
+
+// Prints the samples since the last line and starts over
+func (p *Progress) logSamples(now time.Time) {
+	elapsed := now.Sub(p.log_since)
+	rps := float64(p.last_count-p.log_count) / elapsed.Seconds()
+	if p.warmingUp() {
+		log.Printf("Warming up %6d requests, %9.2f rps\n", p.last_count, rps)
+	} else {
+		log.Printf("Completed %6d requests, %9.2f rps\n", p.last_count, rps)
+	}
+	logLatencies(p.log_hists, elapsed)
+	logServerStats(p.log_server)
+	if len(p.log_errors) != 0 {
+		log.Printf("    errors     %s\n", formatErrorCounts(p.log_errors))
+	}
+
+	p.resetLog(now)
+}
+
+// Samples taken so far
+func (p *Progress) samples() []IntervalReport {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]IntervalReport(nil), p.intervals...)
+}
+
+/* ----- */
+
+// Builds the report for the command, so far. If warm-up is not over yet then
+// everything goes to warm-up and the measured window is empty.
+func (p *Progress) buildReport() *CommandReport {
+	now := time.Now()
+	intervals := p.samples()
+	since, count := p.measured()
+	elapsed := now.Sub(since)
+
+	warming := p.warmingUp()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	errors := make(map[string]int64, len(p.errors))
+	for code, n := range p.errors {
+		errors[code] = n
+	}
+
+	report := &CommandReport{
+		Name:     p.name,
+		Conc:     p.conc,
+		Conns:    p.conns,
+		Started:  since,
+		Finished: now,
+		Errors:   errors,
+		Cliffs:   p.cliffs.allEvents(),
+		Warmup:   p.warmup}
+
+	if warming {
+		report.Started = now
+		report.Errors = map[string]int64{}
+		report.Warmup = &WarmupReport{
+			Elapsed:   elapsed.Seconds(),
+			Requests:  count,
+			Rps:       float64(count) / elapsed.Seconds(),
+			Errors:    errors,
+			Intervals: intervals}
+		return report
+	}
+
+	report.Elapsed = elapsed.Seconds()
+	report.Requests = count
+	report.Rps = float64(count) / elapsed.Seconds()
+	report.Ops = newOpReports(p.latency.takeTotal(), elapsed)
+	report.Intervals = intervals
+	return report
+}
+
+// Counts a failed call, and if that is over the error budget, saves the
+// results so far and exits
+func (p *Progress) failed(code ResultCode, err error) {
+	class := classifyError(code, err)
+
+	p.mutex.Lock()
+	p.errors[class]++
+	p.interval_errors[class]++
+	p.error_count++
+	error_count := p.error_count
+	calls := p.completed() - p.base_count + error_count
+	p.mutex.Unlock()
+
+	METRICS.addError(class)
+
+	if !p.budget.exceeded(error_count, calls) {
+		return
+	}
+
+	// Never returns, other workers which get here block in Do until it exits
+	p.exit_once.Do(func() {
+		if RUN_REPORT != nil {
+			RUN_REPORT.add(p.buildReport())
+			RUN_REPORT.write()
+		}
+
+		if error_count > 1 {
+			log.Printf("Error budget exceeded: %d errors\n", error_count)
+		}
+		log.Fatalf("Error calling function: %d, %s", code, err)
+	})
+}
+
+func (p *Progress) logErrors() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.error_count == 0 {
+		return
+	}
+
+	calls := p.completed() - p.base_count + p.error_count
+	log.Printf("Errors: %d of %d calls (%.3f%%): %s\n", p.error_count, calls,
+		float64(p.error_count)*100/float64(calls), formatErrorCounts(p.errors))
+}
+
+func (p *Progress) logConnections(elapsed time.Duration) {
+	if p.conns < 2 {
+		return
+	}
+
+	conn_counts := make([]int64, p.conns)
+	for i := range p.counters {
+		c := &p.counters[i]
+		conn_counts[c.conn] += atomic.LoadInt64(&c.count)
+	}
+	for i, count := range conn_counts {
+		log.Printf("    conn %-5d n = %7d, %9.2f rps\n", i, count, float64(count)/elapsed.Seconds())
+	}
+}
+
+/* ----- */
+
+// One worker goroutine, the connection it is using and its own random source
+
+type Worker struct {
+	*Progress
+
+	id   int
+	conn int
+	rnd  *rand.Rand
+}
+
+func (p *Progress) newWorker(id int, conn int, seed int64) *Worker {
+	p.counters[id].conn = int64(conn)
+	return &Worker{Progress: p, id: id, conn: conn, rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (w *Worker) increment() {
+	atomic.AddInt64(&w.counters[w.id].count, 1)
+	if w.warmup_count > 0 && w.warmingUp() && atomic.AddInt64(&w.warmup_left, -1) == 0 {
+		w.endWarmup()
+	}
+}
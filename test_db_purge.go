@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/tarantool/go-tarantool"
+	"log"
+	"time"
+)
+
+/* ----- */
+
+// Inactive device purge, the purge command: deletes devices which have not
+// pinged for -retention together with their subs, walking the devs ping_ts
+// index in batches of -purge-batch. Devices with a sub pinged within -retention
+// are kept. With -dry-run the devices are only listed.
+
+var PURGE_RETENTION_DEFAULT = time.Duration(TIME_MS_5_DAYS) * time.Millisecond
+
+func runPurge(client *tarantool.Connection, retention time.Duration, batch int, dry_run bool) {
+	model := NewPushDbModel(client)
+
+	now := milliTime()
+	before_ts := now - Millitime(retention/time.Millisecond)
+
+	if dry_run {
+		log.Printf("Purge dry run, devices not pinged since %s (%s)\n", milliTimeFormat(before_ts), retention)
+	} else {
+		log.Printf("Purging devices not pinged since %s (%s)\n", milliTimeFormat(before_ts), retention)
+	}
+
+	start := time.Now()
+
+	var cursor_ts Millitime
+	var cursor_skip int
+	var devs, subs, kept, batches int
+
+	for {
+		batch_start := time.Now()
+		res, err := model.doPurgeDevs(cursor_ts, cursor_skip, before_ts, batch, dry_run)
+		if err != nil {
+			log.Fatalf("Error purging devices: %s", err)
+		}
+		batches++
+
+		for _, item := range res.list {
+			if item.kept {
+				kept++
+				if dry_run {
+					log.Printf("    would keep %s, sub pinged %s, %d subs\n",
+						item.dev_id, milliTimeFormat(item.ping_ts), item.subs)
+				}
+			} else if dry_run {
+				log.Printf("    would purge %s, last ping %s, %d subs\n",
+					item.dev_id, milliTimeFormat(item.ping_ts), item.subs)
+			}
+		}
+		if !dry_run && res.devs > 0 {
+			log.Printf("Purged %d devices, %d subs in %s\n", res.devs, res.subs, time.Since(batch_start))
+		}
+
+		devs += res.devs
+		subs += res.subs
+		cursor_ts = res.next_ts
+		cursor_skip = res.next_skip
+
+		if res.done {
+			break
+		}
+	}
+
+	elapsed := time.Since(start)
+	if dry_run {
+		log.Printf("Would purge %d devices, %d subs, would keep %d devices with recently pinged subs\n",
+			devs, subs, kept)
+	} else {
+		log.Printf("Purged %d devices, %d subs in %d batches, %s, %.2f devices/s\n",
+			devs, subs, batches, elapsed, float64(devs)/elapsed.Seconds())
+		log.Printf("Kept %d devices with recently pinged subs\n", kept)
+	}
+}
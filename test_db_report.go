@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* ----- */
+
+// Machine readable results of a whole run, written with -out as JSON or CSV
+
+type OpReport struct {
+	Op    string  `json:"op"`
+	Count int64   `json:"count"`
+	Rps   float64 `json:"rps"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	P999  float64 `json:"p999_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+type IntervalReport struct {
+	Time     time.Time        `json:"time"`
+	Elapsed  float64          `json:"elapsed_s"`
+	Requests int64            `json:"requests"`
+	Rps      float64          `json:"rps"`
+	Ops      []OpReport       `json:"ops"`
+	Errors   map[string]int64 `json:"errors,omitempty"`
+	Server   *ServerStats     `json:"server,omitempty"`
+}
+
+// Everything before the measured window of a command, when -warmup is given
+type WarmupReport struct {
+	Elapsed   float64          `json:"elapsed_s"`
+	Requests  int64            `json:"requests"`
+	Rps       float64          `json:"rps"`
+	Errors    map[string]int64 `json:"errors,omitempty"`
+	Intervals []IntervalReport `json:"intervals"`
+}
+
+type CommandReport struct {
+	Name      string           `json:"name"`
+	Phase     string           `json:"phase,omitempty"`
+	Conc      int              `json:"conc"`
+	Conns     int              `json:"conns"`
+	Started   time.Time        `json:"started"`
+	Finished  time.Time        `json:"finished"`
+	Elapsed   float64          `json:"elapsed_s"`
+	Requests  int64            `json:"requests"`
+	Rps       float64          `json:"rps"`
+	Ops       []OpReport       `json:"ops"`
+	Errors    map[string]int64 `json:"errors"`
+	Cliffs    []CliffEvent     `json:"cliffs"`
+	Intervals []IntervalReport `json:"intervals"`
+	Warmup    *WarmupReport    `json:"warmup,omitempty"`
+}
+
+type RunReport struct {
+	Started    time.Time         `json:"started"`
+	Finished   time.Time         `json:"finished"`
+	Flags      map[string]string `json:"flags"`
+	Args       []string          `json:"args"`
+	Commands   []*CommandReport  `json:"commands"`
+	Sweeper    *SweeperReport    `json:"sweeper,omitempty"`
+	Dispatcher *DispatcherReport `json:"dispatcher,omitempty"`
+
+	path string
+}
+
+// Set in main when -out is given
+var RUN_REPORT *RunReport = nil
+
+func NewRunReport(path string, args []string) *RunReport {
+	r := &RunReport{Started: time.Now(), Flags: make(map[string]string), Args: args, path: path}
+	flag.VisitAll(func(f *flag.Flag) {
+		r.Flags[f.Name] = f.Value.String()
+	})
+	return r
+}
+
+func newOpReports(hists [OP_COUNT]*Histogram, elapsed time.Duration) []OpReport {
+	res := make([]OpReport, 0, OP_COUNT)
+	for op, h := range hists {
+		if h.count == 0 {
+			continue
+		}
+		res = append(res, OpReport{
+			Op:    OpKind(op).String(),
+			Count: h.count,
+			Rps:   float64(h.count) / elapsed.Seconds(),
+			P50:   durationMillis(h.percentile(50)),
+			P90:   durationMillis(h.percentile(90)),
+			P99:   durationMillis(h.percentile(99)),
+			P999:  durationMillis(h.percentile(99.9)),
+			Max:   durationMillis(h.maxDuration())})
+	}
+	return res
+}
+
+func (r *RunReport) add(cmd *CommandReport) {
+	if r == nil {
+		return
+	}
+	r.Commands = append(r.Commands, cmd)
+}
+
+func (r *RunReport) write() {
+	if r == nil {
+		return
+	}
+
+	r.Finished = time.Now()
+	r.Sweeper = SWEEPER.buildReport()
+	r.Dispatcher = DISPATCHER.buildReport()
+
+	var err error
+	if strings.ToLower(filepath.Ext(r.path)) == ".csv" {
+		err = r.writeCsv()
+	} else {
+		err = r.writeJson()
+	}
+	if err != nil {
+		log.Printf("Error writing results to %s: %s\n", r.path, err)
+		return
+	}
+
+	log.Printf("Results written to %s\n", r.path)
+}
+
+func (r *RunReport) writeJson() error {
+	f, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// One row per flag, per operation in each interval and command total, per server
+// counter in each interval, per cliff, per error code and per sweeper and
+// dispatcher total. Warm-up intervals and the warm-up total have their own kinds.
+
+var CSV_HEADER = []string{"command", "conns", "kind", "time", "elapsed_s", "requests", "rps",
+	"name", "count", "op_rps", "p50_ms", "p90_ms", "p99_ms", "p999_ms", "max_ms", "value"}
+
+func (r *RunReport) writeCsv() error {
+	f, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write(CSV_HEADER)
+
+	for name, value := range r.Flags {
+		w.Write([]string{"", "", "flag", formatCsvTime(r.Started), "", "", "",
+			name, "", "", "", "", "", "", "", value})
+	}
+
+	for _, cmd := range r.Commands {
+		name := cmd.Name
+		if cmd.Phase != "" {
+			name = cmd.Phase + ":" + cmd.Name
+		}
+		prefix := []string{name, fmt.Sprint(cmd.Conns)}
+
+		if cmd.Warmup != nil {
+			writeCsvIntervals(w, prefix, "warmup_interval", cmd.Warmup.Intervals)
+			w.Write(append(prefix, "warmup", formatCsvTime(cmd.Started), formatCsvFloat(cmd.Warmup.Elapsed),
+				fmt.Sprint(cmd.Warmup.Requests), formatCsvFloat(cmd.Warmup.Rps),
+				"", "", "", "", "", "", "", "", ""))
+			for code, count := range cmd.Warmup.Errors {
+				w.Write(append(prefix, "warmup_error", formatCsvTime(cmd.Started), "", "", "",
+					code, fmt.Sprint(count), "", "", "", "", "", "", ""))
+			}
+		}
+
+		writeCsvIntervals(w, prefix, "interval", cmd.Intervals)
+
+		row := append(prefix, "total", formatCsvTime(cmd.Finished), formatCsvFloat(cmd.Elapsed),
+			fmt.Sprint(cmd.Requests), formatCsvFloat(cmd.Rps))
+		writeCsvOps(w, row, cmd.Ops)
+
+		for _, e := range cmd.Cliffs {
+			ended := ""
+			if !e.Ended.IsZero() {
+				ended = formatCsvTime(e.Ended)
+			}
+			w.Write(append(prefix, "cliff", formatCsvTime(e.Started), "", fmt.Sprint(e.StartRequests),
+				formatCsvFloat(e.MeanRps), "baseline", "", formatCsvFloat(e.Baseline), "", "", "", "", "", ended))
+		}
+
+		for code, count := range cmd.Errors {
+			w.Write(append(prefix, "error", formatCsvTime(cmd.Finished), "", "", "",
+				code, fmt.Sprint(count), "", "", "", "", "", "", ""))
+		}
+	}
+
+	if sw := r.Sweeper; sw != nil {
+		for _, nv := range [][2]string{
+			{"passes", fmt.Sprint(sw.Passes)},
+			{"batches", fmt.Sprint(sw.Batches)},
+			{"swept", fmt.Sprint(sw.Swept)},
+			{"scanned", fmt.Sprint(sw.Scanned)},
+			{"errors", fmt.Sprint(sw.Errors)},
+			{"batch_p50_ms", formatCsvFloat(sw.BatchP50)},
+			{"batch_p99_ms", formatCsvFloat(sw.BatchP99)},
+			{"batch_max_ms", formatCsvFloat(sw.BatchMax)}} {
+			w.Write([]string{"", "", "sweeper", formatCsvTime(r.Finished), "", "", "",
+				nv[0], "", "", "", "", "", "", "", nv[1]})
+		}
+	}
+
+	if dp := r.Dispatcher; dp != nil {
+		for _, nv := range [][2]string{
+			{"polls", fmt.Sprint(dp.Polls)},
+			{"taken", fmt.Sprint(dp.Taken)},
+			{"sent", fmt.Sprint(dp.Sent)},
+			{"priority", fmt.Sprint(dp.Priority)},
+			{"failed", fmt.Sprint(dp.Failed)},
+			{"errors", fmt.Sprint(dp.Errors)}} {
+			w.Write([]string{"", "", "dispatcher", formatCsvTime(r.Finished), "", "", "",
+				nv[0], "", "", "", "", "", "", "", nv[1]})
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func writeCsvIntervals(w *csv.Writer, prefix []string, kind string, intervals []IntervalReport) {
+	for _, in := range intervals {
+		row := append(prefix, kind, formatCsvTime(in.Time), formatCsvFloat(in.Elapsed),
+			fmt.Sprint(in.Requests), formatCsvFloat(in.Rps))
+		writeCsvOps(w, row, in.Ops)
+
+		for class, count := range in.Errors {
+			w.Write(append(prefix, kind+"_error", formatCsvTime(in.Time), formatCsvFloat(in.Elapsed), "", "",
+				class, fmt.Sprint(count), "", "", "", "", "", "", ""))
+		}
+
+		if in.Server != nil {
+			for _, nv := range in.Server.csvValues() {
+				w.Write(append(prefix, "server", formatCsvTime(in.Server.Time), formatCsvFloat(in.Elapsed), "", "",
+					nv[0], "", "", "", "", "", "", "", nv[1]))
+			}
+		}
+	}
+}
+
+func writeCsvOps(w *csv.Writer, row []string, ops []OpReport) {
+	if len(ops) == 0 {
+		w.Write(append(row[:len(row):len(row)], "", "", "", "", "", "", "", "", ""))
+		return
+	}
+	for _, op := range ops {
+		w.Write(append(row[:len(row):len(row)], op.Op, fmt.Sprint(op.Count), formatCsvFloat(op.Rps),
+			formatCsvFloat(op.P50), formatCsvFloat(op.P90), formatCsvFloat(op.P99),
+			formatCsvFloat(op.P999), formatCsvFloat(op.Max), ""))
+	}
+}
+
+func formatCsvTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+func formatCsvFloat(v float64) string {
+	return fmt.Sprintf("%.3f", v)
+}
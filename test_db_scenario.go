@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+/* ----- */
+
+// A benchmark plan for "run -f scenario.json", a list of phases run one after
+// another. Fields left out of a phase keep their command line values.
+//
+//	{
+//	  "name": "seed and ping",
+//	  "phases": [
+//	    {"name": "seed", "workload": "subs", "conc": 20, "count": 100000},
+//	    {"workload": "ping", "conc": 50, "duration": "60s", "rate": 5000,
+//	     "dist": "zipf:1.2", "warmup": "5s", "pause": "10s"},
+//	    {"workload": "mix", "mix": "ping=80,change=20", "conns": 4, "duration": "60s"}
+//	  ]
+//	}
+
+type ScenarioPhase struct {
+	Name     string `json:"name"`
+	Workload string `json:"workload"`
+	Conc     int    `json:"conc"`
+	Count    int    `json:"count"`
+	Duration string `json:"duration"`
+	Warmup   string `json:"warmup"`
+	Rate     int    `json:"rate"`
+	Dist     string `json:"dist"`
+	Mix      string `json:"mix"`
+	Churn    string `json:"churn"`
+	Sim      string `json:"sim"`
+	Pipeline int    `json:"pipeline"`
+	Conns    int    `json:"conns"`
+	Keylen   int    `json:"keylen"`
+	Keys     string `json:"keys"`
+	Pause    string `json:"pause"`
+
+	// Resolved against the command line flags
+	flags Flags
+	conns int
+	mix   *MixWeights
+	pause time.Duration
+}
+
+type Scenario struct {
+	Name   string           `json:"name"`
+	Out    string           `json:"out"`
+	Phases []*ScenarioPhase `json:"phases"`
+
+	path string
+}
+
+// Parses the arguments of the run command
+func parseRunArgs(args []string, base Flags, base_conns int) (*Scenario, error) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	path := fs.String("f", "", "Scenario file, JSON")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *path == "" || fs.NArg() != 0 {
+		return nil, errors.New("Expected run -f scenario.json")
+	}
+
+	return loadScenario(*path, base, base_conns)
+}
+
+func loadScenario(path string, base Flags, base_conns int) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := &Scenario{path: path}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(sc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(sc.Phases) == 0 {
+		return nil, fmt.Errorf("%s: no phases", path)
+	}
+
+	for i, ph := range sc.Phases {
+		if ph.Name == "" {
+			ph.Name = fmt.Sprintf("%d-%s", i+1, ph.Workload)
+		}
+		if err := ph.resolve(base, base_conns); err != nil {
+			return nil, fmt.Errorf("%s: phase %q: %s", path, ph.Name, err)
+		}
+	}
+
+	return sc, nil
+}
+
+func (ph *ScenarioPhase) resolve(base Flags, base_conns int) error {
+	if !isCommand(ph.Workload) {
+		return fmt.Errorf("Unknown workload %q", ph.Workload)
+	}
+
+	flags := base
+	conns := base_conns
+
+	if ph.Conc != 0 {
+		flags.conc = ph.Conc
+	}
+	if ph.Count != 0 {
+		flags.total = ph.Count
+	}
+	if ph.Duration != "" {
+		d, err := time.ParseDuration(ph.Duration)
+		if err != nil {
+			return err
+		}
+		flags.duration = d
+	}
+	if ph.Warmup != "" {
+		flags.warmup = ph.Warmup
+	}
+	if ph.Rate != 0 {
+		flags.rate = ph.Rate
+	}
+	if ph.Dist != "" {
+		flags.dist = ph.Dist
+	}
+	if ph.Mix != "" {
+		flags.mix = ph.Mix
+	}
+	if ph.Churn != "" {
+		flags.churn = ph.Churn
+	}
+	if ph.Sim != "" {
+		flags.sim = ph.Sim
+	}
+	if ph.Pipeline != 0 {
+		flags.pipeline = ph.Pipeline
+	}
+	if ph.Conns != 0 {
+		conns = ph.Conns
+	}
+	if ph.Keylen != 0 {
+		flags.keylen = ph.Keylen
+	}
+	if ph.Keys != "" {
+		flags.keys = ph.Keys
+	}
+	if ph.Pause != "" {
+		d, err := time.ParseDuration(ph.Pause)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Invalid pause %q", ph.Pause)
+		}
+		ph.pause = d
+	}
+
+	if !checkFlags(flags) || conns < 1 {
+		return errors.New("Invalid conc, count, duration, rate, pipeline, conns or keylen")
+	}
+	if _, _, err := parseWarmup(flags.warmup); err != nil {
+		return err
+	}
+	if _, err := parseKeyDist(flags.dist); err != nil {
+		return err
+	}
+	mix, err := parseMixWeights(flags.mix)
+	if err != nil {
+		return err
+	}
+	if err := checkCommandFlags(ph.Workload, flags); err != nil {
+		return err
+	}
+
+	ph.flags = flags
+	ph.conns = conns
+	ph.mix = mix
+	return nil
+}
+
+/* ----- */
+
+func runScenario(sc *Scenario, pool *ClientPool) {
+	log.Printf("Scenario %s: %s, %d phases\n", sc.path, sc.Name, len(sc.Phases))
+
+	reports := make([]*CommandReport, len(sc.Phases))
+
+	for i, ph := range sc.Phases {
+		log.Printf("Phase %d of %d: %s\n", i+1, len(sc.Phases), ph.Name)
+
+		if !runJobCommand(ph.Workload, ph.flags, pool) {
+			reports[i] = runCommand(ph.Workload, ph.flags, ph.mix, pool.get(ph.conns))
+			reports[i].Phase = ph.Name
+		}
+
+		if ph.pause > 0 && i < len(sc.Phases)-1 {
+			log.Printf("Pause: %s\n", ph.pause)
+			time.Sleep(ph.pause)
+		}
+	}
+
+	log.Printf("Scenario summary:\n")
+	for i, ph := range sc.Phases {
+		r := reports[i]
+		if r == nil {
+			log.Printf("    %-20s %-8s\n", ph.Name, ph.Workload)
+			continue
+		}
+		var errs int64
+		for _, n := range r.Errors {
+			errs += n
+		}
+		log.Printf("    %-20s %-8s conns %3d, c %4d, n %9d, %9.2f rps, %d errors\n",
+			ph.Name, ph.Workload, r.Conns, r.Conc, r.Requests, r.Rps, errs)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/tarantool/go-tarantool"
@@ -8,58 +9,126 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
 const (
-	LOAD_COUNT = 100000
+	LOAD_PAGE_SIZE = 10000
+	LOAD_LOG_EVERY = 1000000
 )
 
 /* ----- */
 
 type Flags struct {
-	conc   int
-	total  int
-	keylen int
+	conc     int
+	total    int
+	keylen   int
+	rate     int
+	duration time.Duration
+	interval time.Duration
+	mix      string
+	churn    string
+	sim      string
+	dist     string
+	conns    string
+	pipeline int
+	out      string
+	metrics  string
+	keys     string
+
+	max_errors string
+	seed       int64
+	warmup     string
+
+	server_stats time.Duration
+	log_interval time.Duration
+
+	sweep       time.Duration
+	sweep_age   time.Duration
+	sweep_batch int
+
+	retention   time.Duration
+	purge_batch int
+	dry_run     bool
+
+	dispatch       time.Duration
+	dispatch_batch int
+	dispatch_conc  int
+	dispatch_lease time.Duration
+	dispatch_delay time.Duration
+
+	cliff_pct float64
+	cliff_dur time.Duration
 }
 
-func usage() {
-	fmt.Printf("Usage %s subs ping change\n", filepath.Base(os.Args[0]))
-	os.Exit(1)
-}
+// Commands that can be given on the command line or as scenario workloads
+var COMMANDS = []string{"subs", "ping", "change", "list", "mix", "churn", "sim", "save", "load", "purge"}
 
-type WorkerFunc func(*tarantool.Connection, int, int, *Progress)
+// Commands which run once rather than as a harness workload, see runJobCommand
+var JOB_COMMANDS = []string{"save", "load", "purge"}
 
-type Progress struct {
-	total int32
-	count int32
+func isCommand(command string) bool {
+	return hasCommand(COMMANDS, command)
+}
 
-	last_since time.Time
-	last_count int32
+func hasCommand(list []string, command string) bool {
+	for _, c := range list {
+		if c == command {
+			return true
+		}
+	}
+	return false
 }
 
-func NewProgress(total int) *Progress {
-	return &Progress{total: int32(total)}
+func usage() {
+	fmt.Printf("Usage %s %s\n", filepath.Base(os.Args[0]), strings.Join(COMMANDS, " "))
+	fmt.Printf("      %s run -f scenario.json\n", filepath.Base(os.Args[0]))
+	fmt.Printf("      %s compare a.json b.json\n", filepath.Base(os.Args[0]))
+	os.Exit(1)
 }
 
-func (p *Progress) increment() {
-	new_count := atomic.AddInt32(&p.count, 1)
+func checkFlags(flags Flags) bool {
+	return flags.conc >= 1 && flags.total >= 1 && flags.keylen >= 10 && flags.rate >= 0 &&
+		flags.duration >= 0 && flags.interval > 0 && flags.log_interval > 0 && flags.pipeline >= 1 &&
+		flags.cliff_pct >= 0 && flags.cliff_pct < 100 && flags.server_stats >= 0 &&
+		flags.sweep >= 0 && flags.sweep_age > 0 && flags.sweep_batch >= 1 &&
+		flags.retention > 0 && flags.purge_batch >= 1 &&
+		flags.dispatch >= 0 && flags.dispatch_batch >= 1 && flags.dispatch_conc >= 1 &&
+		flags.dispatch_lease > 0 && flags.dispatch_delay >= 0
+}
 
-	if new_count == 1 {
-		p.last_since = time.Now()
-		p.last_count = 0
-	} else if p.total > 100 && (new_count%(p.total/10)) == 0 {
-		now := time.Now()
-		elapsed := now.Sub(p.last_since).Seconds()
-		rps := float64(new_count-p.last_count) / elapsed
-		p.last_since = now
-		p.last_count = new_count
-		log.Printf("Completed %6d requests, %9.2f rps\n", new_count, rps)
+// What some commands need on top of checkFlags
+func checkCommandFlags(command string, flags Flags) error {
+	if flags.pipeline > 1 && !hasCommand(PIPELINE_COMMANDS, command) && !hasCommand(JOB_COMMANDS, command) {
+		return fmt.Errorf("The %s command does not support -pipeline, only %s do", command,
+			strings.Join(PIPELINE_COMMANDS, ", "))
 	}
+	if (command == "save" || command == "load") && flags.keys == "" {
+		return fmt.Errorf("The %s command needs -keys", command)
+	}
+	if command == "churn" {
+		if _, err := parseChurnWeights(flags.churn); err != nil {
+			return err
+		}
+	}
+	if command == "sim" {
+		if flags.duration == 0 {
+			return errors.New("The sim command needs -d")
+		}
+		if _, err := parseSimConfig(flags.sim); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+type WorkerFunc func(*tarantool.Connection, int, int, *Worker)
+
 /* ----- */
 
 type DevFolderSub struct {
@@ -68,87 +137,188 @@ type DevFolderSub struct {
 	sub_id    string
 }
 
-func NewDevFolderSub_DbEnt(ent SubEnt) DevFolderSub {
-	return DevFolderSub{dev_id: ent.dev_id, folder_id: ent.folder_id, sub_id: ent.sub_id}
-}
-
 func NewDevFolderSub_Vars(dev_id string, folder_id string, sub_id string) DevFolderSub {
 	return DevFolderSub{dev_id: dev_id, folder_id: folder_id, sub_id: sub_id}
 }
 
 var LIST_ENTS []DevFolderSub = nil
-var LIST_MUTEX sync.Mutex
+var LIST_MUTEX sync.RWMutex
 
-func loadDevicesAndSubs(client *tarantool.Connection, numreq int) ([]DevFolderSub, int) {
+// Seeds of worker random sources, from -seed so that runs can be replayed
+var SEED_RAND *rand.Rand = nil
 
-	schema := client.Schema
+func sortListEnts() {
+	LIST_MUTEX.Lock()
+	defer LIST_MUTEX.Unlock()
 
-	space_subs := schema.Spaces["subs"]
-	index_subs_primary := space_subs.Indexes["primary"]
+	sort.Slice(LIST_ENTS, func(i, j int) bool {
+		a, b := LIST_ENTS[i], LIST_ENTS[j]
+		if a.dev_id != b.dev_id {
+			return a.dev_id < b.dev_id
+		}
+		return a.folder_id < b.folder_id
+	})
+}
+
+func loadDevicesAndSubs(client *tarantool.Connection, numreq int) ([]DevFolderSub, int) {
 
 	LIST_MUTEX.Lock()
 	defer LIST_MUTEX.Unlock()
 
 	needLoad := LIST_ENTS == nil
 	if needLoad {
-		log.Println("Loading sub and device ids")
+		LIST_ENTS = loadAllSubs(client)
+	}
+
+	ent_count := len(LIST_ENTS)
+
+	if numreq > ent_count {
+		if needLoad {
+			log.Printf("Limiting %d iterations to %d existing ents", numreq, ent_count)
+		}
+		numreq = ent_count
+	}
 
-		LIST_ENTS = make([]DevFolderSub, 0, LOAD_COUNT)
+	return LIST_ENTS, numreq
+}
 
+// Ping, change and list need something to call, and there is nothing in an
+// empty database until subs or load is run
+func noListEnts(p *Worker) {
+	if p.id == 0 {
+		log.Printf("No devices and subs to use, run subs or load first\n")
+	}
+}
+
+// Pages through the subs dev_id index. It's not unique, so each page starts at
+// the last dev_id seen and skips the subs of that dev_id which are already loaded.
+func loadAllSubs(client *tarantool.Connection) []DevFolderSub {
+
+	schema := client.Schema
+
+	space_subs := schema.Spaces["subs"]
+	index_subs_dev_id := space_subs.Indexes["dev_id"]
+
+	log.Println("Loading sub and device ids")
+
+	var mem_before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem_before)
+
+	start := time.Now()
+
+	list_ents := make([]DevFolderSub, 0, LOAD_PAGE_SIZE)
+
+	// Folder ids repeat across devices, keep one copy of each
+	folder_ids := make(map[string]string)
+
+	key := []interface{}{}
+	last_dev_id := ""
+	last_dev_count := 0
+	next_log := LOAD_LOG_EVERY
+
+	for {
 		var subs []SubEnt
-		err := client.SelectTyped(space_subs, index_subs_primary, 0, LOAD_COUNT, tarantool.IterAll, []interface{}{}, &subs)
+		err := client.SelectTyped(space_subs, index_subs_dev_id, uint32(last_dev_count), LOAD_PAGE_SIZE,
+			tarantool.IterGe, key, &subs)
 		if err != nil {
 			log.Fatalf("Error calling select: %s", err)
 		}
 
 		for _, sub := range subs {
-			LIST_ENTS = append(LIST_ENTS, NewDevFolderSub_DbEnt(sub))
-		}
-	}
+			if sub.dev_id == last_dev_id {
+				last_dev_count++
+			} else {
+				last_dev_id = sub.dev_id
+				last_dev_count = 1
+			}
 
-	ent_count := len(LIST_ENTS)
+			folder_id, ok := folder_ids[sub.folder_id]
+			if !ok {
+				folder_id = sub.folder_id
+				folder_ids[folder_id] = folder_id
+			}
 
-	if needLoad {
-		log.Printf("Loaded %d ents", ent_count)
-	}
+			// Reuses the dev_id string of the previous sub of the same device
+			list_ents = append(list_ents, DevFolderSub{dev_id: last_dev_id, folder_id: folder_id, sub_id: sub.sub_id})
+		}
 
-	if numreq > ent_count {
-		if needLoad {
-			log.Printf("Limiting %d iterations to %d existing ents", numreq, ent_count)
+		if len(list_ents) >= next_log {
+			log.Printf("Loaded %d ents...", len(list_ents))
+			next_log += LOAD_LOG_EVERY
 		}
-		numreq = ent_count
+
+		if len(subs) < LOAD_PAGE_SIZE {
+			break
+		}
+		key = []interface{}{last_dev_id}
 	}
 
-	return LIST_ENTS, numreq
+	elapsed := time.Since(start)
+
+	var mem_after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem_after)
+
+	log.Printf("Loaded %d ents in %s, %.2f MB in use (+%.2f MB)", len(list_ents), elapsed,
+		float64(mem_after.HeapAlloc)/(1<<20),
+		(float64(mem_after.HeapAlloc)-float64(mem_before.HeapAlloc))/(1<<20))
+
+	return list_ents
 }
 
 /* ----- */
 
-func runFuncSubs(client *tarantool.Connection, keylen int, numreq int, p *Progress) {
+func runFuncSubs(client *tarantool.Connection, keylen int, numreq int, p *Worker) {
 
-	// Create and save devices and subscriptions
-	list_ents := make([]DevFolderSub, 0, numreq)
+	all_ents := make([]DevFolderSub, 0, numreq)
 
 	model := NewPushDbModel(client)
 
-	for i := 0; i < numreq; i++ {
-		dev_id := genRandomString(keylen)
-		auth := genRandomString(AUTH_STRING_LEN)
-		push_token := genPushToken()
+	// In duration mode keep creating numreq devices per round until the deadline
+	for round := 0; round == 0 || p.timed() && !p.expired(); round++ {
+		list_ents := runSubsRound(model, keylen, numreq, p)
+		all_ents = append(all_ents, list_ents...)
+	}
+
+	LIST_MUTEX.Lock()
+	defer LIST_MUTEX.Unlock()
+
+	if LIST_ENTS == nil {
+		LIST_ENTS = make([]DevFolderSub, 0, len(all_ents))
+	}
+	LIST_ENTS = append(LIST_ENTS, all_ents...)
+}
+
+func runSubsRound(model *PushDbModel, keylen int, numreq int, p *Worker) []DevFolderSub {
+
+	// Create and save devices and subscriptions
+	list_ents := make([]DevFolderSub, 0, numreq)
+
+	for i := 0; i < numreq && !p.expired(); i++ {
+		dev_id := genRandomString(p.rnd, keylen)
+		auth := genRandomString(p.rnd, AUTH_STRING_LEN)
+		push_token := genPushToken(p.rnd)
 		now := milliTime()
 
 		// Model
+		start := p.begin()
 		t_dev, code, err := model.doCreateDev(dev_id, auth, push_token, PUSH_TECH_GCM_DEBUG, now)
+		p.observe(OP_CREATE_DEV, start)
 		if t_dev == nil || code != RES_OK || err != nil {
-			log.Fatalf("Error calling function: %s", err)
+			p.failed(code, err)
+			continue
 		}
 
 		// Model
 		folder_id := fmt.Sprintf("%08d", i)
-		sub_id := genRandomString(keylen)
+		sub_id := genRandomString(p.rnd, keylen)
+		start = p.begin()
 		code, err = model.doCreateSub(dev_id, folder_id, sub_id, now)
+		p.observe(OP_CREATE_SUB, start)
 		if code != RES_OK || err != nil {
-			log.Fatalf("Error calling function: %s", err)
+			p.failed(code, err)
+			continue
 		}
 
 		p.increment()
@@ -157,52 +327,53 @@ func runFuncSubs(client *tarantool.Connection, keylen int, numreq int, p *Progre
 	}
 
 	// Add more subscriptions to the devices
-	for i := 0; i < numreq; i++ {
+	for i := 0; i < len(list_ents) && !p.expired(); i++ {
 		dev_id := list_ents[i].dev_id
 
 		// Model
 		folder_id := fmt.Sprintf("%08d", numreq+i)
-		sub_id := genRandomString(keylen)
+		sub_id := genRandomString(p.rnd, keylen)
 		now := milliTime()
+		start := p.begin()
 		code, err := model.doCreateSub(dev_id, folder_id, sub_id, now)
+		p.observe(OP_CREATE_SUB, start)
 		if code != RES_OK || err != nil {
-			log.Fatalf("Error calling function: %d, %s", code, err)
+			p.failed(code, err)
+			continue
 		}
 		p.increment()
 
 		// Model
 		folder_id = fmt.Sprintf("%08d", numreq+numreq+i)
-		sub_id = genRandomString(keylen)
+		sub_id = genRandomString(p.rnd, keylen)
 		now = milliTime()
+		start = p.begin()
 		code, err = model.doCreateSub(dev_id, folder_id, sub_id, now)
+		p.observe(OP_CREATE_SUB, start)
 		if code != RES_OK || err != nil {
-			log.Fatalf("Error calling function: %d, %s", code, err)
+			p.failed(code, err)
+			continue
 		}
 		p.increment()
 	}
 
-	LIST_MUTEX.Lock()
-	defer LIST_MUTEX.Unlock()
-
-	if LIST_ENTS == nil {
-		LIST_ENTS = make([]DevFolderSub, 0, numreq)
-	}
-	for i, ent := range list_ents {
-		LIST_ENTS = append(LIST_ENTS, ent)
-		if i == numreq {
-			break
-		}
-	}
+	return list_ents
 }
 
-func runFuncPing(client *tarantool.Connection, keylen int, numreq int, p *Progress) {
+func runFuncPing(client *tarantool.Connection, keylen int, numreq int, p *Worker) {
 	list_ents, numreq := loadDevicesAndSubs(client, numreq)
 	size_ents := len(list_ents)
+	if size_ents == 0 {
+		noListEnts(p)
+		return
+	}
 
 	model := NewPushDbModel(client)
+	chooser := p.dist.newChooser(p.rnd)
+	pipeline := NewPipeline(p, p.pipeline)
 
-	for i := 0; i < numreq; i++ {
-		index := rand.Intn(size_ents)
+	for i := 0; p.more(i, numreq); i++ {
+		index := chooser.next(size_ents)
 		ent := list_ents[index]
 		dev_id := ent.dev_id
 		folder_id := ent.folder_id
@@ -211,25 +382,43 @@ func runFuncPing(client *tarantool.Connection, keylen int, numreq int, p *Progre
 		ping_ts := milliTime()
 
 		// Model
+		if pipeline != nil {
+			pipeline.reserve()
+			start := p.begin()
+			pipeline.add(OP_PING_SUB, start, model.doPingSubAsync(dev_id, folder_id, sub_id, ping_ts))
+			continue
+		}
+
+		start := p.begin()
 		code, err := model.doPingSub(dev_id, folder_id, sub_id, ping_ts)
+		p.observe(OP_PING_SUB, start)
 		if code != RES_OK || err != nil {
-			log.Fatalf("Error calling function: %d, %s", code, err)
+			p.failed(code, err)
+			continue
 		}
 
 		p.increment()
 	}
+
+	pipeline.drain()
 }
 
-func runFuncChange(client *tarantool.Connection, keylen int, numreq int, p *Progress) {
+func runFuncChange(client *tarantool.Connection, keylen int, numreq int, p *Worker) {
 	priority := false
 
 	list_ents, numreq := loadDevicesAndSubs(client, numreq)
 	size_ents := len(list_ents)
+	if size_ents == 0 {
+		noListEnts(p)
+		return
+	}
 
 	model := NewPushDbModel(client)
+	chooser := p.dist.newChooser(p.rnd)
+	pipeline := NewPipeline(p, p.pipeline)
 
-	for i := 0; i < numreq; i++ {
-		index := rand.Intn(size_ents)
+	for i := 0; p.more(i, numreq); i++ {
+		index := chooser.next(size_ents)
 		ent := list_ents[index]
 		dev_id := ent.dev_id
 		folder_id := ent.folder_id
@@ -239,41 +428,144 @@ func runFuncChange(client *tarantool.Connection, keylen int, numreq int, p *Prog
 		delta := TIME_MS_500_MILLIS
 
 		// Model
+		if pipeline != nil {
+			pipeline.reserve()
+			start := p.begin()
+			pipeline.add(OP_CHANGE_SUB, start, model.doChangeSubAsync(dev_id, folder_id, sub_id, change_ts, delta, priority))
+			continue
+		}
+
+		start := p.begin()
 		code, err := model.doChangeSub(dev_id, folder_id, sub_id, change_ts, delta, priority)
+		p.observe(OP_CHANGE_SUB, start)
 		if code != RES_OK || err != nil {
-			log.Fatalf("Error calling function: %d, %s", code, err)
+			p.failed(code, err)
+			continue
 		}
 
 		p.increment()
 	}
+
+	pipeline.drain()
 }
 
-func runHarness(flags Flags, client *tarantool.Connection, worker WorkerFunc) {
-	rand.Seed(time.Now().UTC().UnixNano())
+// Read path: lists the subs of devices from the key pool
+func runFuncList(client *tarantool.Connection, keylen int, numreq int, p *Worker) {
+	list_ents, numreq := loadDevicesAndSubs(client, numreq)
+	size_ents := len(list_ents)
+	if size_ents == 0 {
+		noListEnts(p)
+		return
+	}
+
+	model := NewPushDbModel(client)
+	chooser := p.dist.newChooser(p.rnd)
+	pipeline := NewPipeline(p, p.pipeline)
+
+	for i := 0; p.more(i, numreq); i++ {
+		index := chooser.next(size_ents)
+		dev_id := list_ents[index].dev_id
+
+		// Model
+		if pipeline != nil {
+			pipeline.reserve()
+			start := p.begin()
+			pipeline.add(OP_LIST_SUBS, start, model.doListSubsAsync(dev_id))
+			continue
+		}
+
+		start := p.begin()
+		_, code, err := model.doListSubs(dev_id)
+		p.observe(OP_LIST_SUBS, start)
+		if code != RES_OK || err != nil {
+			p.failed(code, err)
+			continue
+		}
+
+		p.increment()
+	}
 
+	pipeline.drain()
+}
+
+func runHarness(name string, flags Flags, clients []*tarantool.Connection, worker WorkerFunc) *CommandReport {
 	log.Printf("Key length: %d\n", flags.keylen)
+	log.Printf("Key distribution: %s\n", flags.dist)
+	if flags.seed != 0 {
+		log.Printf("Seed: %d\n", flags.seed)
+	}
+	log.Printf("Connections: %d\n", len(clients))
+	if flags.pipeline > 1 {
+		log.Printf("Pipeline depth: %d\n", flags.pipeline)
+	}
+	if flags.rate > 0 {
+		log.Printf("Open loop, target rate: %d calls/s\n", flags.rate)
+	}
+	if flags.duration > 0 {
+		log.Printf("Duration: %s\n", flags.duration)
+	}
+	if d, n, _ := parseWarmup(flags.warmup); d > 0 || n > 0 {
+		log.Printf("Warm-up: %s\n", flags.warmup)
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(flags.conc)
 
 	now := time.Now()
-	progress := NewProgress(flags.total)
+	progress := NewProgress(name, flags, len(clients))
+	METRICS.setCommand(name)
+	defer METRICS.setCommand("")
+
+	if flags.server_stats > 0 {
+		progress.server = startServerStats(SERVER_STATS_CLIENT, flags.server_stats)
+	}
+	progress.startSampler(flags.interval)
 
 	for i := 0; i < flags.conc; i++ {
 		numreq := flags.total / flags.conc
 		keylen := flags.keylen
+		w := progress.newWorker(i, i%len(clients), SEED_RAND.Int63())
 		go func(keylen, numreq int) {
 			defer wg.Done()
-			worker(client, keylen, numreq, progress)
+			worker(clients[w.conn], keylen, numreq, w)
 		}(keylen, numreq)
 	}
 
 	wg.Wait()
+	progress.stopSampler()
+
+	if flags.seed != 0 {
+		// Workers add to the key pool in the order they finish
+		sortListEnts()
+	}
+	progress.server.stop()
+
+	measured_since, measured_count := progress.measured()
+	since := time.Since(measured_since)
+
+	if progress.warmingUp() {
+		log.Printf("Warm-up did not finish, nothing was measured\n")
+	} else {
+		log.Printf("Elapsed time: %s\n", since)
+		log.Printf("Ops per second: %.2f\n", float64(measured_count)/since.Seconds())
+	}
+	progress.logConnections(time.Since(now))
+	progress.logErrors()
+	if progress.pacer != nil {
+		progress.pacer.logReport()
+	}
+	log.Printf("Latencies:\n")
+	logLatencies(progress.latency.takeTotal(), since)
+
+	report := progress.buildReport()
+	if len(report.Cliffs) != 0 {
+		log.Printf("Throughput cliffs:\n")
+		logCliffs(report.Cliffs)
+	}
 
-	since := time.Since(now)
+	RUN_REPORT.add(report)
 
-	log.Printf("Elapsed time: %s\n", since)
-	log.Printf("Ops per second: %.2f\n", float64(progress.count)/since.Seconds())
+	return report
 }
 
 /* ----- */
@@ -284,6 +576,39 @@ func main() {
 	flag.IntVar(&flags.conc, "c", 20, "Concurrency")
 	flag.IntVar(&flags.total, "n", 100000, "Total count")
 	flag.IntVar(&flags.keylen, "l", 40, "Key length")
+	flag.IntVar(&flags.rate, "rate", 0, "Open loop target rate, calls per second (0 = closed loop)")
+	flag.DurationVar(&flags.duration, "d", 0, "Run each command for this long instead of a total count")
+	flag.DurationVar(&flags.interval, "i", 250*time.Millisecond, "Progress sampling interval, for the -out results")
+	flag.DurationVar(&flags.log_interval, "log-interval", 10*time.Second, "Print progress this often, use the -i value for every sample")
+	flag.StringVar(&flags.mix, "mix", MIX_DEFAULT, "Operation weights for the mix command")
+	flag.StringVar(&flags.churn, "churn", CHURN_DEFAULT, "Operation weights for the churn command: create, delsub, deldev")
+	flag.StringVar(&flags.sim, "sim", SIM_DEFAULT, "Settings for the sim command: folders, ping, change, burst, think, life, ramp")
+	flag.StringVar(&flags.conns, "conns", "1", "Number of connections, or a list like 1,4,16 to run each command with each")
+	flag.IntVar(&flags.pipeline, "pipeline", 1, "Asynchronous calls kept in flight by each ping, change and list worker")
+	flag.StringVar(&flags.out, "out", "", "Write results to this file, JSON or CSV by extension")
+	flag.StringVar(&flags.keys, "keys", "", "Key pool file for the save and load commands")
+	flag.Float64Var(&flags.cliff_pct, "cliff-pct", 30, "Log throughput drops by more than this percent (0 = off)")
+	flag.DurationVar(&flags.cliff_dur, "cliff-dur", 2*time.Second, "How long a throughput drop must last to be logged")
+	flag.StringVar(&flags.metrics, "metrics", "", "Serve Prometheus metrics on this address, e.g. :9100")
+	flag.DurationVar(&flags.server_stats, "server-stats", 0, "Poll server stats this often, e.g. 1s (0 = off)")
+	flag.DurationVar(&flags.sweep, "sweep", 0, "Sweep stale subs this often while commands run (0 = off)")
+	flag.DurationVar(&flags.sweep_age, "sweep-age", time.Hour, "Subs not pinged for this long are marked dead by the sweeper")
+	flag.IntVar(&flags.sweep_batch, "sweep-batch", 1000, "Subs scanned by one sweeper call")
+	flag.DurationVar(&flags.retention, "retention", PURGE_RETENTION_DEFAULT, "The purge command deletes devices not pinged for this long")
+	flag.IntVar(&flags.purge_batch, "purge-batch", 100, "Devices deleted by one purge call")
+	flag.BoolVar(&flags.dry_run, "dry-run", false, "Only list the devices the purge command would delete")
+	flag.DurationVar(&flags.dispatch, "dispatch", 0, "Poll for devices with pending changes and send pushes this often while commands run (0 = off)")
+	flag.IntVar(&flags.dispatch_batch, "dispatch-batch", 500, "Devices scanned by one dispatcher call")
+	flag.IntVar(&flags.dispatch_conc, "dispatch-conc", 4, "Dispatcher sender goroutines")
+	flag.DurationVar(&flags.dispatch_lease, "dispatch-lease", 30*time.Second, "How long a taken device is not taken again while it's being sent")
+	flag.DurationVar(&flags.dispatch_delay, "dispatch-delay", 0, "Simulated time to send one push")
+	flag.StringVar(&flags.max_errors, "max-errors", "0", "Errors to tolerate before stopping, a count or a percentage like 1%")
+	flag.StringVar(&flags.warmup, "warmup", "", "Run this long, or this many requests, before measuring, e.g. 5s or 10000")
+	flag.Int64Var(&flags.seed, "seed", 0, "Random seed for keys and access sequences (0 = from the clock)")
+	flag.StringVar(&flags.dist, "dist", DIST_UNIFORM, "Key distribution: uniform, zipf[:skew], hotspot[:traffic/keys], seq")
+	var cflags CompareFlags
+	flag.Float64Var(&cflags.threshold, "threshold", 5, "Compare: regression threshold, percent")
+	flag.Float64Var(&cflags.alpha, "alpha", 0.05, "Compare: significance level")
 	flag.Parse()
 
 	nargs := flag.NArg()
@@ -292,10 +617,70 @@ func main() {
 	if nargs < 1 {
 		usage()
 	}
-	if flags.conc < 1 || flags.total < 1 || flags.keylen < 10 {
+
+	// Compare saved results, no database needed
+	if args[0] == "compare" {
+		if nargs != 3 {
+			fmt.Printf("Usage %s compare a.json b.json\n", filepath.Base(os.Args[0]))
+			os.Exit(COMPARE_EXIT_ERROR)
+		}
+		os.Exit(runCompare(cflags, args[1], args[2]))
+	}
+	if !checkFlags(flags) {
+		usage()
+	}
+
+	mix, err := parseMixWeights(flags.mix)
+	if err != nil {
+		fmt.Printf("Invalid -mix: %s\n", err)
+		usage()
+	}
+
+	if _, err := parseErrorBudget(flags.max_errors); err != nil {
+		fmt.Printf("Invalid -max-errors: %s\n", err)
+		usage()
+	}
+
+	if _, _, err := parseWarmup(flags.warmup); err != nil {
+		fmt.Printf("Invalid -warmup: %s\n", err)
 		usage()
 	}
 
+	if _, err := parseKeyDist(flags.dist); err != nil {
+		fmt.Printf("Invalid -dist: %s\n", err)
+		usage()
+	}
+
+	conns_list, err := parseConnCounts(flags.conns)
+	if err != nil {
+		fmt.Printf("Invalid -conns: %s\n", err)
+		usage()
+	}
+
+	// Scenario file, the phases are checked before anything runs
+	var scenario *Scenario
+	if args[0] == "run" {
+		scenario, err = parseRunArgs(args[1:], flags, conns_list[0])
+		if err != nil {
+			fmt.Printf("Invalid scenario: %s\n", err)
+			usage()
+		}
+		if flags.out == "" {
+			flags.out = scenario.Out
+		}
+		args = []string{}
+	}
+
+	for _, command := range args {
+		if !isCommand(command) {
+			usage()
+		}
+		if err := checkCommandFlags(command, flags); err != nil {
+			fmt.Printf("%s\n", err)
+			usage()
+		}
+	}
+
 	// Config
 	config, err := NewDbConfig()
 	if err != nil {
@@ -303,38 +688,159 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Database connection, need only one
-	var client *tarantool.Connection
+	seed := flags.seed
+	if seed == 0 {
+		seed = time.Now().UTC().UnixNano()
+	}
+	SEED_RAND = rand.New(rand.NewSource(seed))
+
+	if flags.out != "" {
+		RUN_REPORT = NewRunReport(flags.out, flag.Args())
+	}
+	if flags.metrics != "" {
+		METRICS = startMetrics(flags.metrics)
+	}
+
+	pool := NewClientPool(config)
+
+	if flags.server_stats > 0 {
+		client, err := config.Connect(config.Bind)
+		if err != nil {
+			log.Fatalf("Failed to connect: %s", err)
+		}
+		SERVER_STATS_CLIENT = client
+	}
+
+	if flags.sweep > 0 {
+		// Its own connection, so that it doesn't queue behind the workers
+		client, err := config.Connect(config.Bind)
+		if err != nil {
+			log.Fatalf("Failed to connect: %s", err)
+		}
+		SWEEPER = startSweeper(client, flags.sweep, flags.sweep_age, flags.sweep_batch)
+	}
+
+	if flags.dispatch > 0 {
+		client, err := config.Connect(config.Bind)
+		if err != nil {
+			log.Fatalf("Failed to connect: %s", err)
+		}
+		sender := &DelaySender{delay: flags.dispatch_delay}
+		DISPATCHER = startDispatcher(client, sender, flags.dispatch, flags.dispatch_lease,
+			flags.dispatch_batch, flags.dispatch_conc)
+	}
+
+	if scenario != nil {
+		runScenario(scenario, pool)
+	}
 
 	// Run commands
 	for _, command := range args {
-		// Connect if needed
-		if client == nil {
-			client_init, err := config.Connect(config.Bind)
-			if err != nil {
-				log.Fatalf("Failed to connect: %s", err)
-			}
+		if runJobCommand(command, flags, pool) {
+			continue
+		}
 
-			client = client_init
+		for _, conns := range conns_list {
+			runCommand(command, flags, mix, pool.get(conns))
 		}
+	}
+
+	SWEEPER.stop()
+	SWEEPER.logReport()
+	DISPATCHER.stop()
+	DISPATCHER.logReport()
+
+	RUN_REPORT.write()
+}
+
+func runCommand(command string, flags Flags, mix *MixWeights, clients []*tarantool.Connection) *CommandReport {
+	// Adjust concurrency
+	if flags.total <= 100 && flags.conc > 1 {
+		fmt.Printf("Total is small, using one thread\n")
+		flags.conc = 1
+	}
+
+	if command == "subs" {
+		log.Printf("Subs test, c = %d, n = %d\n", flags.conc, flags.total)
+		return runHarness(command, flags, clients, runFuncSubs)
+	} else if command == "ping" {
+		log.Printf("Ping test, c = %d, n = %d\n", flags.conc, flags.total)
+		return runHarness(command, flags, clients, runFuncPing)
+	} else if command == "change" {
+		log.Printf("Change test, c = %d, n = %d\n", flags.conc, flags.total)
+		return runHarness(command, flags, clients, runFuncChange)
+	} else if command == "list" {
+		log.Printf("List test, c = %d, n = %d\n", flags.conc, flags.total)
+		return runHarness(command, flags, clients, runFuncList)
+	} else if command == "mix" {
+		log.Printf("Mix test, c = %d, n = %d, mix = %s\n", flags.conc, flags.total, mix)
+		return runHarness(command, flags, clients, newRunFuncMix(mix))
+	} else if command == "churn" {
+		// Already validated in main
+		churn, _ := parseChurnWeights(flags.churn)
+		log.Printf("Churn test, c = %d, n = %d, churn = %s\n", flags.conc, flags.total, churn)
+		return runHarness(command, flags, clients, newRunFuncChurn(churn))
+	} else if command == "sim" {
+		// Already validated in main
+		config, _ := parseSimConfig(flags.sim)
+		log.Printf("Sim test, c = %d, devices = %d, sim = %s\n", flags.conc, flags.total, config)
+		sim := NewSimulator(config)
+		report := runHarness(command, flags, clients, sim.runFunc)
+		sim.logStats()
+		return report
+	}
+
+	usage()
+	return nil
+}
+
+// Commands which run once rather than as a harness workload, returns false for others
+func runJobCommand(command string, flags Flags, pool *ClientPool) bool {
+	if command == "save" {
+		saveListEnts(flags.keys, pool.get(1)[0])
+	} else if command == "load" {
+		loadListEnts(flags.keys)
+	} else if command == "purge" {
+		runPurge(pool.get(1)[0], flags.retention, flags.purge_batch, flags.dry_run)
+	} else {
+		return false
+	}
+	return true
+}
+
+/* ----- */
+
+// Database connections, made as needed. Workers are spread over them round robin.
 
-		// Adjust concurrency
-		if flags.total <= 100 && flags.conc > 1 {
-			fmt.Printf("Total is small, using one thread\n")
-			flags.conc = 1
+type ClientPool struct {
+	config  *PushDbConfig
+	clients []*tarantool.Connection
+}
+
+func NewClientPool(config *PushDbConfig) *ClientPool {
+	return &ClientPool{config: config}
+}
+
+func (pool *ClientPool) get(conns int) []*tarantool.Connection {
+	for len(pool.clients) < conns {
+		client, err := pool.config.Connect(pool.config.Bind)
+		if err != nil {
+			log.Fatalf("Failed to connect: %s", err)
 		}
 
-		if command == "subs" {
-			log.Printf("Subs test, c = %d, n = %d\n", flags.conc, flags.total)
-			runHarness(flags, client, runFuncSubs)
-		} else if command == "ping" {
-			log.Printf("Ping test, c = %d, n = %d\n", flags.conc, flags.total)
-			runHarness(flags, client, runFuncPing)
-		} else if command == "change" {
-			log.Printf("Change test, c = %d, n = %d\n", flags.conc, flags.total)
-			runHarness(flags, client, runFuncChange)
-		} else {
-			usage()
+		pool.clients = append(pool.clients, client)
+	}
+	return pool.clients[:conns]
+}
+
+func parseConnCounts(s string) ([]int, error) {
+	var res []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid connection count %q", part)
 		}
+		res = append(res, n)
 	}
+	return res, nil
 }
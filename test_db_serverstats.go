@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"github.com/tarantool/go-tarantool"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/* ----- */
+
+// Server side counters, polled with -server-stats so that they can be shown
+// next to the client side rps of each interval. Polling has its own connection,
+// so that it doesn't queue behind the workers on the ones being measured.
+
+const SERVER_STATS_EVAL = `
+local function n(v) return math.floor(tonumber(v) or 0) end
+local stat = box.stat()
+local function rps(op) return n((stat[op] or {}).rps) end
+local slab = box.slab.info()
+local info = box.info()
+local lsn = 0
+for _, v in pairs(info.vclock or {}) do lsn = lsn + v end
+return {
+	rps('SELECT'), rps('INSERT'), rps('REPLACE'), rps('UPDATE'),
+	rps('UPSERT'), rps('DELETE'), rps('CALL'), rps('EVAL'),
+	n(slab.arena_used), n(slab.arena_size), n(slab.quota_used), n(slab.quota_size),
+	n(slab.items_used), n(slab.items_size),
+	n(lsn), n(info.uptime),
+	n(box.space.devs:len()), n(box.space.subs:len())
+}
+`
+
+const SERVER_STATS_FIELDS = 18
+
+type ServerStats struct {
+	Time time.Time `json:"time"`
+
+	SelectRps  int64 `json:"select_rps"`
+	InsertRps  int64 `json:"insert_rps"`
+	ReplaceRps int64 `json:"replace_rps"`
+	UpdateRps  int64 `json:"update_rps"`
+	UpsertRps  int64 `json:"upsert_rps"`
+	DeleteRps  int64 `json:"delete_rps"`
+	CallRps    int64 `json:"call_rps"`
+	EvalRps    int64 `json:"eval_rps"`
+
+	ArenaUsed int64 `json:"arena_used"`
+	ArenaSize int64 `json:"arena_size"`
+	QuotaUsed int64 `json:"quota_used"`
+	QuotaSize int64 `json:"quota_size"`
+	ItemsUsed int64 `json:"items_used"`
+	ItemsSize int64 `json:"items_size"`
+
+	Lsn     int64   `json:"lsn"`
+	WalRate float64 `json:"wal_rows_per_sec"`
+	Uptime  int64   `json:"uptime"`
+
+	DevsCount int64 `json:"devs_count"`
+	SubsCount int64 `json:"subs_count"`
+}
+
+func (st *ServerStats) fields() []*int64 {
+	return []*int64{
+		&st.SelectRps, &st.InsertRps, &st.ReplaceRps, &st.UpdateRps,
+		&st.UpsertRps, &st.DeleteRps, &st.CallRps, &st.EvalRps,
+		&st.ArenaUsed, &st.ArenaSize, &st.QuotaUsed, &st.QuotaSize,
+		&st.ItemsUsed, &st.ItemsSize,
+		&st.Lsn, &st.Uptime,
+		&st.DevsCount, &st.SubsCount}
+}
+
+func encodeServerStats(e *msgpack.Encoder, v reflect.Value) error {
+	m := v.Interface().(ServerStats)
+	fields := m.fields()
+	if err := e.EncodeSliceLen(len(fields)); err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if err := e.EncodeInt64(*f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeServerStats(d *msgpack.Decoder, v reflect.Value) error {
+	var err error
+	var l int
+	m := v.Addr().Interface().(*ServerStats)
+	if l, err = d.DecodeSliceLen(); err != nil {
+		return err
+	}
+	if l != SERVER_STATS_FIELDS {
+		return fmt.Errorf("decodeServerStats array len doesn't match: %d", l)
+	}
+	for _, f := range m.fields() {
+		if *f, err = d.DecodeInt64(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	msgpack.Register(reflect.TypeOf(ServerStats{}), encodeServerStats, decodeServerStats)
+}
+
+/* ----- */
+
+// Set in main when -server-stats is given
+var SERVER_STATS_CLIENT *tarantool.Connection = nil
+
+type ServerStatsCollector struct {
+	client   *tarantool.Connection
+	interval time.Duration
+
+	mutex  sync.Mutex
+	latest *ServerStats
+	taken  bool
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func startServerStats(client *tarantool.Connection, interval time.Duration) *ServerStatsCollector {
+	c := &ServerStatsCollector{client: client, interval: interval,
+		done: make(chan struct{}), stopped: make(chan struct{})}
+
+	go c.run()
+
+	return c
+}
+
+func (c *ServerStatsCollector) stop() {
+	if c == nil {
+		return
+	}
+	close(c.done)
+	<-c.stopped
+}
+
+func (c *ServerStatsCollector) run() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	c.poll()
+	for {
+		select {
+		case <-ticker.C:
+			c.poll()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *ServerStatsCollector) poll() {
+	var res []ServerStats
+	err := c.client.EvalTyped(SERVER_STATS_EVAL, []interface{}{}, &res)
+	if err != nil || len(res) != 1 {
+		log.Printf("Error polling server stats: %v\n", err)
+		return
+	}
+
+	st := res[0]
+	st.Time = time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.latest != nil {
+		elapsed := st.Time.Sub(c.latest.Time).Seconds()
+		if elapsed > 0 {
+			st.WalRate = float64(st.Lsn-c.latest.Lsn) / elapsed
+		}
+	}
+	c.latest = &st
+	c.taken = false
+}
+
+// Stats polled since the last call, nil if there are none. Polls are usually
+// less frequent than samples, and each goes to the first sample after it.
+func (c *ServerStatsCollector) take() *ServerStats {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.latest == nil || c.taken {
+		return nil
+	}
+	c.taken = true
+	st := *c.latest
+	return &st
+}
+
+// Name and value pairs for the CSV output
+func (st *ServerStats) csvValues() [][2]string {
+	return [][2]string{
+		{"wal_rows_per_sec", fmt.Sprintf("%.0f", st.WalRate)},
+		{"select_rps", fmt.Sprint(st.SelectRps)},
+		{"insert_rps", fmt.Sprint(st.InsertRps)},
+		{"replace_rps", fmt.Sprint(st.ReplaceRps)},
+		{"update_rps", fmt.Sprint(st.UpdateRps)},
+		{"upsert_rps", fmt.Sprint(st.UpsertRps)},
+		{"delete_rps", fmt.Sprint(st.DeleteRps)},
+		{"arena_used", fmt.Sprint(st.ArenaUsed)},
+		{"quota_used", fmt.Sprint(st.QuotaUsed)},
+		{"items_used", fmt.Sprint(st.ItemsUsed)},
+		{"devs_count", fmt.Sprint(st.DevsCount)},
+		{"subs_count", fmt.Sprint(st.SubsCount)}}
+}
+
+func logServerStats(st *ServerStats) {
+	if st == nil {
+		return
+	}
+	log.Printf("    server     wal %8.0f rows/s, replace %6d, update %6d, upsert %6d rps, "+
+		"arena %d/%d MB, quota %d/%d MB, devs %d, subs %d\n",
+		st.WalRate, st.ReplaceRps, st.UpdateRps, st.UpsertRps,
+		st.ArenaUsed>>20, st.ArenaSize>>20, st.QuotaUsed>>20, st.QuotaSize>>20,
+		st.DevsCount, st.SubsCount)
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/tarantool/go-tarantool"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/* ----- */
+
+// Device lifecycle simulator: every virtual device registers, subscribes its
+// folders, pings each of its subs on a schedule, gets bursts of changes and
+// after its lifetime goes away and is replaced by a new device. Each worker
+// owns -n / -c devices and drives them from a timer queue, so the load comes
+// from per-device rates rather than back to back calls.
+//
+//	folders=N   - subs per device
+//	ping=D      - how often each sub is pinged
+//	change=D    - mean time between change bursts of a device
+//	burst=N     - max changes in a burst, spread over the device's subs
+//	think=D     - mean pause between registration steps and before re-registering
+//	life=D      - mean device lifetime, 0 = devices never go away
+//	ramp=D      - first registrations are spread over this long
+
+const (
+	SIM_DEFAULT = "folders=3,ping=5m,change=2m,burst=5,think=200ms,life=0,ramp=30s"
+)
+
+type SimConfig struct {
+	folders int
+	ping    time.Duration
+	change  time.Duration
+	burst   int
+	think   time.Duration
+	life    time.Duration
+	ramp    time.Duration
+}
+
+func parseSimConfig(s string) (*SimConfig, error) {
+	c := &SimConfig{}
+	if s != SIM_DEFAULT {
+		// Settings left out keep their defaults
+		c, _ = parseSimConfig(SIM_DEFAULT)
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid sim setting %q, expected name=value", part)
+		}
+
+		name, value := kv[0], kv[1]
+		switch name {
+		case "folders", "burst":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("Invalid sim %s %q", name, value)
+			}
+			if name == "folders" {
+				c.folders = n
+			} else {
+				c.burst = n
+			}
+		case "ping", "change", "think", "life", "ramp":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 || d == 0 && (name == "ping" || name == "change") {
+				return nil, fmt.Errorf("Invalid sim %s %q", name, value)
+			}
+			switch name {
+			case "ping":
+				c.ping = d
+			case "change":
+				c.change = d
+			case "think":
+				c.think = d
+			case "life":
+				c.life = d
+			case "ramp":
+				c.ramp = d
+			}
+		default:
+			return nil, fmt.Errorf("Unknown sim setting %q", name)
+		}
+	}
+
+	return c, nil
+}
+
+func (c *SimConfig) String() string {
+	return fmt.Sprintf("folders=%d,ping=%s,change=%s,burst=%d,think=%s,life=%s,ramp=%s",
+		c.folders, c.ping, c.change, c.burst, c.think, c.life, c.ramp)
+}
+
+/* ----- */
+
+const (
+	SIM_EV_REGISTER = iota
+	SIM_EV_SUBSCRIBE
+	SIM_EV_PING
+	SIM_EV_CHANGE
+	SIM_EV_LEAVE
+)
+
+type SimDevice struct {
+	dev_id  string
+	sub_ids []string
+
+	// Bumped when the device goes away, its pending events are then dropped
+	gen uint32
+
+	next_ping int
+}
+
+type SimEvent struct {
+	at   int64
+	dev  int32
+	gen  uint32
+	kind uint8
+}
+
+// Min heap of events by time
+type SimQueue []SimEvent
+
+func (q SimQueue) Len() int            { return len(q) }
+func (q SimQueue) Less(i, j int) bool  { return q[i].at < q[j].at }
+func (q SimQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *SimQueue) Push(x interface{}) { *q = append(*q, x.(SimEvent)) }
+func (q *SimQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	ev := old[n-1]
+	*q = old[:n-1]
+	return ev
+}
+
+/* ----- */
+
+// Shared by the workers of one sim command
+type Simulator struct {
+	config *SimConfig
+
+	registered int64
+	left       int64
+	max_lag    int64
+}
+
+func NewSimulator(config *SimConfig) *Simulator {
+	return &Simulator{config: config}
+}
+
+func (sim *Simulator) logStats() {
+	log.Printf("Simulated devices: %d registered, %d went away, max schedule lag %s\n",
+		atomic.LoadInt64(&sim.registered), atomic.LoadInt64(&sim.left),
+		time.Duration(atomic.LoadInt64(&sim.max_lag)))
+}
+
+func (sim *Simulator) addLag(lag time.Duration) {
+	for {
+		old := atomic.LoadInt64(&sim.max_lag)
+		if int64(lag) <= old || atomic.CompareAndSwapInt64(&sim.max_lag, old, int64(lag)) {
+			return
+		}
+	}
+}
+
+// One worker and the devices it owns
+type SimWorker struct {
+	*Simulator
+
+	model  *PushDbModel
+	keylen int
+	p      *Worker
+
+	devs  []SimDevice
+	queue SimQueue
+}
+
+func (sim *Simulator) runFunc(client *tarantool.Connection, keylen int, numreq int, p *Worker) {
+	w := &SimWorker{Simulator: sim, model: NewPushDbModel(client), keylen: keylen, p: p,
+		devs: make([]SimDevice, numreq), queue: make(SimQueue, 0, numreq*3)}
+
+	now := time.Now()
+	for i := range w.devs {
+		w.schedule(i, SIM_EV_REGISTER, now.Add(randDuration(p.rnd, sim.config.ramp)))
+	}
+
+	for w.queue.Len() > 0 {
+		ev := heap.Pop(&w.queue).(SimEvent)
+
+		at := time.Unix(0, ev.at)
+		if wait := time.Until(at); wait > 0 {
+			if time.Now().Add(wait).After(p.deadline) {
+				time.Sleep(time.Until(p.deadline))
+				return
+			}
+			time.Sleep(wait)
+		} else {
+			sim.addLag(-wait)
+		}
+		if p.expired() {
+			return
+		}
+
+		d := &w.devs[ev.dev]
+		if ev.gen != d.gen {
+			continue
+		}
+
+		switch ev.kind {
+		case SIM_EV_REGISTER:
+			w.register(int(ev.dev))
+		case SIM_EV_SUBSCRIBE:
+			w.subscribe(int(ev.dev))
+		case SIM_EV_PING:
+			w.ping(int(ev.dev))
+		case SIM_EV_CHANGE:
+			w.change(int(ev.dev))
+		case SIM_EV_LEAVE:
+			w.leave(int(ev.dev))
+		}
+	}
+}
+
+func (w *SimWorker) schedule(i int, kind uint8, at time.Time) {
+	heap.Push(&w.queue, SimEvent{at: at.UnixNano(), dev: int32(i), gen: w.devs[i].gen, kind: kind})
+}
+
+func (w *SimWorker) after(i int, kind uint8, d time.Duration) {
+	w.schedule(i, kind, time.Now().Add(d))
+}
+
+func (w *SimWorker) register(i int) {
+	p := w.p
+	d := &w.devs[i]
+
+	dev_id := genRandomString(p.rnd, w.keylen)
+	auth := genRandomString(p.rnd, AUTH_STRING_LEN)
+	push_token := genPushToken(p.rnd)
+	now := milliTime()
+
+	// Model
+	start := p.begin()
+	t_dev, code, err := w.model.doCreateDev(dev_id, auth, push_token, PUSH_TECH_GCM_DEBUG, now)
+	p.observe(OP_CREATE_DEV, start)
+	if t_dev == nil || code != RES_OK || err != nil {
+		p.failed(code, err)
+		w.after(i, SIM_EV_REGISTER, jitterDuration(p.rnd, w.config.think))
+		return
+	}
+	p.increment()
+
+	d.dev_id = dev_id
+	d.sub_ids = make([]string, 0, w.config.folders)
+	atomic.AddInt64(&w.registered, 1)
+
+	w.after(i, SIM_EV_SUBSCRIBE, jitterDuration(p.rnd, w.config.think))
+}
+
+func (w *SimWorker) subscribe(i int) {
+	p := w.p
+	d := &w.devs[i]
+
+	folder_id := fmt.Sprintf("%08d", len(d.sub_ids))
+	sub_id := genRandomString(p.rnd, w.keylen)
+	now := milliTime()
+
+	// Model
+	start := p.begin()
+	code, err := w.model.doCreateSub(d.dev_id, folder_id, sub_id, now)
+	p.observe(OP_CREATE_SUB, start)
+	if code != RES_OK || err != nil {
+		p.failed(code, err)
+		w.after(i, SIM_EV_SUBSCRIBE, jitterDuration(p.rnd, w.config.think))
+		return
+	}
+	p.increment()
+
+	d.sub_ids = append(d.sub_ids, sub_id)
+	addListEnt(NewDevFolderSub_Vars(d.dev_id, folder_id, sub_id))
+
+	if len(d.sub_ids) < w.config.folders {
+		w.after(i, SIM_EV_SUBSCRIBE, jitterDuration(p.rnd, w.config.think))
+		return
+	}
+
+	// Active, each sub gets pinged once per ping interval
+	w.after(i, SIM_EV_PING, randDuration(p.rnd, w.pingInterval()))
+	w.after(i, SIM_EV_CHANGE, expDuration(p.rnd, w.config.change))
+	if w.config.life > 0 {
+		w.after(i, SIM_EV_LEAVE, expDuration(p.rnd, w.config.life))
+	}
+}
+
+func (w *SimWorker) pingInterval() time.Duration {
+	return w.config.ping / time.Duration(w.config.folders)
+}
+
+func (w *SimWorker) ping(i int) {
+	p := w.p
+	d := &w.devs[i]
+
+	n := d.next_ping % len(d.sub_ids)
+	d.next_ping++
+
+	ent := NewDevFolderSub_Vars(d.dev_id, fmt.Sprintf("%08d", n), d.sub_ids[n])
+	if mixPingSub(w.model, ent, p) {
+		p.increment()
+	}
+
+	w.after(i, SIM_EV_PING, jitterDuration(p.rnd, w.pingInterval()))
+}
+
+func (w *SimWorker) change(i int) {
+	p := w.p
+	d := &w.devs[i]
+
+	burst := 1 + p.rnd.Intn(w.config.burst)
+	for j := 0; j < burst && !p.expired(); j++ {
+		n := p.rnd.Intn(len(d.sub_ids))
+		ent := NewDevFolderSub_Vars(d.dev_id, fmt.Sprintf("%08d", n), d.sub_ids[n])
+		if mixChangeSub(w.model, ent, p) {
+			p.increment()
+		}
+	}
+
+	w.after(i, SIM_EV_CHANGE, expDuration(p.rnd, w.config.change))
+}
+
+// The device stops using the service, a new one takes its place
+func (w *SimWorker) leave(i int) {
+	d := &w.devs[i]
+
+	*d = SimDevice{gen: d.gen + 1}
+	atomic.AddInt64(&w.left, 1)
+
+	w.after(i, SIM_EV_REGISTER, jitterDuration(w.p.rnd, w.config.think))
+}
+
+/* ----- */
+
+// Uniform in [0, d)
+func randDuration(rnd *rand.Rand, d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(d)))
+}
+
+// Uniform in [d/2, 3d/2)
+func jitterDuration(rnd *rand.Rand, d time.Duration) time.Duration {
+	return d/2 + randDuration(rnd, d)
+}
+
+// Exponential with mean d
+func expDuration(rnd *rand.Rand, d time.Duration) time.Duration {
+	return time.Duration(rnd.ExpFloat64() * float64(d))
+}
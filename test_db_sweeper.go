@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/tarantool/go-tarantool"
+	"log"
+	"sync"
+	"time"
+)
+
+/* ----- */
+
+// Stale sub sweeper, runs next to the harness commands with -sweep. Every pass
+// walks the subs ping_ts index in batches with push_SweepSubs and marks subs
+// which were not pinged for -sweep-age as dead. A ping moves a sub's ping_ts
+// forward, so each pass continues from where the last one ended instead of
+// walking the subs it has already marked again. Batch durations go to the
+// metrics and to the report so that they can be lined up with foreground rps.
+
+type SweeperReport struct {
+	Passes   int64   `json:"passes"`
+	Batches  int64   `json:"batches"`
+	Swept    int64   `json:"swept"`
+	Scanned  int64   `json:"scanned"`
+	Errors   int64   `json:"errors"`
+	BatchP50 float64 `json:"batch_p50_ms"`
+	BatchP99 float64 `json:"batch_p99_ms"`
+	BatchMax float64 `json:"batch_max_ms"`
+	LastPass float64 `json:"last_pass_s"`
+}
+
+// Set in main when -sweep is given
+var SWEEPER *Sweeper = nil
+
+type Sweeper struct {
+	model    *PushDbModel
+	interval time.Duration
+	age      Millitime
+	batch    int
+
+	mutex     sync.Mutex
+	report    SweeperReport
+	durations *Histogram
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func startSweeper(client *tarantool.Connection, interval time.Duration, age time.Duration, batch int) *Sweeper {
+	s := &Sweeper{model: NewPushDbModel(client), interval: interval,
+		age: Millitime(age / time.Millisecond), batch: batch, durations: NewHistogram(),
+		done: make(chan struct{}), stopped: make(chan struct{})}
+
+	log.Printf("Sweeping subs not pinged for %s every %s, batch %d\n", age, interval, batch)
+
+	go s.run()
+
+	return s
+}
+
+func (s *Sweeper) stop() {
+	if s == nil {
+		return
+	}
+	close(s.done)
+	<-s.stopped
+}
+
+func (s *Sweeper) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	var cursor_ts Millitime
+	var cursor_skip int
+
+	for {
+		select {
+		case <-ticker.C:
+			cursor_ts, cursor_skip = s.pass(cursor_ts, cursor_skip)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Sweeper) stopping() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// One walk over the index, from the cursor up to now - age, returns where it ended
+func (s *Sweeper) pass(cursor_ts Millitime, cursor_skip int) (Millitime, int) {
+	start := time.Now()
+	before_ts := milliTime() - s.age
+
+	var swept, scanned int
+
+	for !s.stopping() {
+		batch_start := time.Now()
+		res, err := s.model.doSweepSubs(cursor_ts, cursor_skip, before_ts, s.batch)
+		d := time.Since(batch_start)
+		if err != nil {
+			log.Printf("Error sweeping subs: %s\n", err)
+			s.mutex.Lock()
+			s.report.Errors++
+			s.mutex.Unlock()
+			return cursor_ts, cursor_skip
+		}
+
+		METRICS.observeSweep(d, res.swept, res.scanned)
+
+		s.mutex.Lock()
+		s.durations.record(d)
+		s.report.Batches++
+		s.report.Swept += int64(res.swept)
+		s.report.Scanned += int64(res.scanned)
+		s.mutex.Unlock()
+
+		swept += res.swept
+		scanned += res.scanned
+		cursor_ts = res.next_ts
+		cursor_skip = res.next_skip
+
+		if res.done {
+			break
+		}
+	}
+
+	elapsed := time.Since(start)
+
+	METRICS.addSweepPass()
+
+	s.mutex.Lock()
+	s.report.Passes++
+	s.report.LastPass = elapsed.Seconds()
+	s.mutex.Unlock()
+
+	log.Printf("Sweeper: %d of %d scanned subs marked dead in %s\n", swept, scanned, elapsed)
+
+	return cursor_ts, cursor_skip
+}
+
+// Totals so far, nil when the sweeper is off
+func (s *Sweeper) buildReport() *SweeperReport {
+	if s == nil {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r := s.report
+	r.BatchP50 = durationMillis(s.durations.percentile(50))
+	r.BatchP99 = durationMillis(s.durations.percentile(99))
+	r.BatchMax = durationMillis(s.durations.maxDuration())
+	return &r
+}
+
+func (s *Sweeper) logReport() {
+	r := s.buildReport()
+	if r == nil {
+		return
+	}
+	log.Printf("Sweeper: %d passes, %d batches, %d of %d scanned subs marked dead, %d errors\n",
+		r.Passes, r.Batches, r.Swept, r.Scanned, r.Errors)
+	log.Printf("    batch p50 %.3f ms, p99 %.3f ms, max %.3f ms\n", r.BatchP50, r.BatchP99, r.BatchMax)
+}